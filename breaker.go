@@ -0,0 +1,142 @@
+package synced
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState is a state of a circuit breaker
+type BreakerState int
+
+// circuit breaker states
+const (
+	BreakerClosed   BreakerState = iota // operations are allowed
+	BreakerOpen                         // operations are rejected
+	BreakerHalfOpen                     // trial operations are allowed to check for recovery
+)
+
+// String implements fmt.Stringer
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerParams are circuit breaker parameters
+type BreakerParams struct {
+	// FailureThreshold is the number of consecutive failures opening the breaker
+	FailureThreshold int
+	// SuccessThreshold is the number of consecutive successes in half-open state closing the breaker
+	SuccessThreshold int
+	// ResetTimeout is the duration of open state after which the breaker becomes half-open
+	ResetTimeout time.Duration
+}
+
+// Breaker is a thread-safe circuit breaker
+type Breaker struct {
+	p         BreakerParams
+	state     BreakerState
+	failures  int
+	successes int
+	openedAt  time.Time
+	sync.Mutex
+
+	// OnStateChange is called each time the breaker state changes.
+	// It is called synchronously by the changing goroutine after the breaker is unlocked.
+	OnStateChange func(from, to BreakerState)
+}
+
+// NewBreaker returns a pointer to a new closed circuit breaker. Thresholds less than 1 are treated as 1
+func NewBreaker(p BreakerParams) *Breaker {
+	if p.FailureThreshold < 1 {
+		p.FailureThreshold = 1
+	}
+	if p.SuccessThreshold < 1 {
+		p.SuccessThreshold = 1
+	}
+	return &Breaker{p: p, state: BreakerClosed}
+}
+
+// setState sets the breaker state. Returns a function notifying about the change to be called
+// after unlocking, or nil if the state was not changed
+func (b *Breaker) setState(state BreakerState) func() {
+	if b.state == state {
+		return nil
+	}
+	from, onStateChange := b.state, b.OnStateChange
+	b.state, b.failures, b.successes = state, 0, 0
+	if state == BreakerOpen {
+		b.openedAt = time.Now()
+	}
+	if onStateChange == nil {
+		return nil
+	}
+	return func() { onStateChange(from, state) }
+}
+
+// notify calls a function returned by setState if it is not nil
+func (b *Breaker) notify(fn func()) {
+	if fn != nil {
+		fn()
+	}
+}
+
+// Allow returns true if an operation is allowed. Open breaker becomes half-open after the reset timeout
+func (b *Breaker) Allow() bool {
+	b.Lock()
+	var notify func()
+	if b.state == BreakerOpen && time.Now().Sub(b.openedAt) >= b.p.ResetTimeout {
+		notify = b.setState(BreakerHalfOpen)
+	}
+	allowed := b.state != BreakerOpen
+	b.Unlock()
+	b.notify(notify)
+	return allowed
+}
+
+// RecordSuccess records a successful operation
+func (b *Breaker) RecordSuccess() {
+	b.Lock()
+	var notify func()
+	switch b.state {
+	case BreakerClosed:
+		b.failures = 0
+	case BreakerHalfOpen:
+		b.successes++
+		if b.successes >= b.p.SuccessThreshold {
+			notify = b.setState(BreakerClosed)
+		}
+	}
+	b.Unlock()
+	b.notify(notify)
+}
+
+// RecordFailure records a failed operation
+func (b *Breaker) RecordFailure() {
+	b.Lock()
+	var notify func()
+	switch b.state {
+	case BreakerClosed:
+		b.failures++
+		if b.failures >= b.p.FailureThreshold {
+			notify = b.setState(BreakerOpen)
+		}
+	case BreakerHalfOpen:
+		notify = b.setState(BreakerOpen)
+	}
+	b.Unlock()
+	b.notify(notify)
+}
+
+// State returns current breaker state
+func (b *Breaker) State() BreakerState {
+	b.Lock()
+	defer b.Unlock()
+	return b.state
+}
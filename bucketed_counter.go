@@ -0,0 +1,97 @@
+package synced
+
+import (
+	"sync"
+	"time"
+)
+
+// BucketedCounter is a thread-safe counter of events within a sliding time window.
+// The window is split into buckets, the oldest one is discarded each time the window advances.
+type BucketedCounter struct {
+	buckets        []int
+	current        int
+	bucketDuration time.Duration
+	ticker         *time.Ticker
+	closeC         chan struct{}
+	closeOnce      sync.Once
+	sync.Mutex
+}
+
+// NewBucketedCounter returns a pointer to a new bucketed counter with the window of n buckets
+// each of bucketDuration long. At least one bucket of at least a millisecond is used, smaller n
+// and bucketDuration are raised to that. Close should be called to stop advancing the window.
+func NewBucketedCounter(n int, bucketDuration time.Duration) *BucketedCounter {
+	bucketDuration = clampInterval(bucketDuration)
+	if n < 1 {
+		n = 1
+	}
+	c := &BucketedCounter{
+		buckets:        make([]int, n),
+		bucketDuration: bucketDuration,
+		ticker:         time.NewTicker(bucketDuration),
+		closeC:         make(chan struct{}),
+	}
+	go func() {
+		for {
+			select {
+			case <-c.ticker.C:
+				c.advance()
+			case <-c.closeC:
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func (c *BucketedCounter) advance() {
+	c.Lock()
+	defer c.Unlock()
+	c.current = (c.current + 1) % len(c.buckets)
+	c.buckets[c.current] = 0
+}
+
+// Inc increases current bucket by 1
+func (c *BucketedCounter) Inc() { c.Add(1) }
+
+// Add i to current bucket
+func (c *BucketedCounter) Add(i int) {
+	c.Lock()
+	defer c.Unlock()
+	c.buckets[c.current] += i
+}
+
+func (c *BucketedCounter) sum() int {
+	sum := 0
+	for _, v := range c.buckets {
+		sum += v
+	}
+	return sum
+}
+
+// Sum returns the total over the window
+func (c *BucketedCounter) Sum() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.sum()
+}
+
+// Window returns the window length
+func (c *BucketedCounter) Window() time.Duration {
+	return time.Duration(len(c.buckets)) * c.bucketDuration
+}
+
+// RatePerSec returns the total over the window divided by the window length in seconds
+func (c *BucketedCounter) RatePerSec() float64 {
+	c.Lock()
+	defer c.Unlock()
+	return float64(c.sum()) / c.Window().Seconds()
+}
+
+// Close stops advancing the window
+func (c *BucketedCounter) Close() {
+	c.closeOnce.Do(func() {
+		c.ticker.Stop()
+		close(c.closeC)
+	})
+}
@@ -1,24 +1,209 @@
 package synced
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+	"unsafe"
+)
+
+// DefaultApproachingMaxFraction is the default fraction of math.MaxInt
+// at which Counter.OnApproachingMax is called
+const DefaultApproachingMaxFraction = 0.9
+
+// counter errors
+var (
+	// ErrCounterUnderflow is returned on an attempt to decrease counter below zero, or below the min of a bounded counter
+	ErrCounterUnderflow = errors.New("counter underflow")
+	// ErrNegativeAmount is returned on an attempt to subtract a negative amount where it must not add to counter
+	ErrNegativeAmount = errors.New("negative amount")
+	// ErrCounterOverflow is returned on an attempt to return permits beyond the counter capacity
+	ErrCounterOverflow = errors.New("counter overflow")
 )
 
 // Counter that is thread-safe
 type Counter struct {
 	count int
+	name  string
 	sync.Mutex
+
+	bounded  bool // the value is clamped into [min, max]
+	min, max int
+
+	// OnApproachingMax is called under the counter lock with the current value once the value
+	// crosses the approaching max threshold, see SetApproachingMaxFraction. It is called again
+	// only after the value drops below the threshold and crosses it once more.
+	OnApproachingMax       func(current int)
+	approachingMaxFraction float64
+	approachingMaxFired    bool
+
+	audit    []CounterOp // ring of the last operations
+	auditPos int
+
+	cond          *sync.Cond // broadcasted on the counter changes if there are borrowers
+	nextTicket    uint64     // ticket of the next borrower to wait, borrowers are served in tickets order
+	servedTicket  uint64     // ticket of the borrower to be served
+	cancelled     map[uint64]bool
+	capacity      int
+	capOnOverflow bool
+}
+
+// CounterOp is a record of a counter mutating operation
+type CounterOp struct {
+	Op          string
+	Delta       int
+	Value       int
+	GoroutineID uint64
 }
 
 // NewCounter returns a new synced counter initialized by initialValue
-func NewCounter(initialValue int) Counter { return Counter{initialValue, sync.Mutex{}} }
+func NewCounter(initialValue int) Counter { return Counter{count: initialValue} }
+
+// NewNamedCounter returns a new synced counter named by name initialized by initialValue.
+// Named counter is marshaled to JSON as an object holding both name and value.
+func NewNamedCounter(name string, initialValue int) Counter {
+	return Counter{count: initialValue, name: name}
+}
+
+// NewBoundedCounter returns a new synced counter initialized by initialValue whose value is clamped
+// into [min, max], so the mutating methods never move it past the bounds
+func NewBoundedCounter(initialValue, min, max int) Counter {
+	return Counter{count: clampInt(initialValue, min, max), bounded: true, min: min, max: max}
+}
+
+// clampInt returns v clamped into [min, max]
+func clampInt(v, min, max int) int {
+	switch {
+	case v < min:
+		return min
+	case v > max:
+		return max
+	}
+	return v
+}
+
+// minTickInterval is the shortest interval the tickers of the package components are raised to,
+// so a non-positive or tiny interval neither panics in time.NewTicker nor spins the CPU
+const minTickInterval = time.Millisecond
+
+// clampInterval returns d raised to minTickInterval if it is shorter
+func clampInterval(d time.Duration) time.Duration {
+	if d < minTickInterval {
+		return minTickInterval
+	}
+	return d
+}
+
+// clamp returns v clamped into the counter bounds if it is bounded
+func (c *Counter) clamp(v int) int {
+	if !c.bounded {
+		return v
+	}
+	return clampInt(v, c.min, c.max)
+}
+
+// floor returns the least value counter may be decreased to by TryDec, TrySub, TryAcquire and Release,
+// the min of a bounded counter or zero
+func (c *Counter) floor() int {
+	if c.bounded {
+		return c.min
+	}
+	return 0
+}
+
+// Name returns the counter name
+func (c *Counter) Name() string {
+	c.Lock()
+	defer c.Unlock()
+	return c.name
+}
+
+func (c *Counter) dec()      { c.update("Dec", c.count-1) }
+func (c *Counter) inc()      { c.update("Inc", c.count+1) }
+func (c *Counter) add(i int) { c.update("Add", c.count+i) }
+func (c *Counter) sub(i int) { c.update("Sub", c.count-i) }
+func (c *Counter) set(i int) { c.update("Set", i) }
+
+func (c *Counter) update(op string, v int) {
+	v = c.clamp(v)
+	delta := v - c.count
+	c.count = v
+	c.record(op, delta)
+	c.checkApproachingMax()
+	if c.cond != nil {
+		c.cond.Broadcast()
+	}
+}
+
+// record adds an operation to the audit trail if it is enabled
+func (c *Counter) record(op string, delta int) {
+	if cap(c.audit) == 0 {
+		return
+	}
+	entry := CounterOp{Op: op, Delta: delta, Value: c.count, GoroutineID: goroutineID()}
+	if len(c.audit) < cap(c.audit) {
+		c.audit = append(c.audit, entry)
+		return
+	}
+	c.audit[c.auditPos] = entry
+	c.auditPos = (c.auditPos + 1) % len(c.audit)
+}
+
+// SetAuditSize enables keeping the audit trail of the last n mutating operations, 0 disables it.
+// The existing trail is discarded. Recording operations is slow, so use it for debugging only.
+func (c *Counter) SetAuditSize(n int) {
+	c.Lock()
+	defer c.Unlock()
+	c.audit, c.auditPos = nil, 0
+	if n > 0 {
+		c.audit = make([]CounterOp, 0, n)
+	}
+}
+
+// Audit returns the audit trail from the earliest to the latest operation
+func (c *Counter) Audit() []CounterOp {
+	c.Lock()
+	defer c.Unlock()
+	audit := make([]CounterOp, 0, len(c.audit))
+	audit = append(audit, c.audit[c.auditPos:]...)
+	return append(audit, c.audit[:c.auditPos]...)
+}
+
+// approachingMaxThreshold returns the value at which OnApproachingMax is called
+func (c *Counter) approachingMaxThreshold() int {
+	fraction := c.approachingMaxFraction
+	if fraction == 0 {
+		fraction = DefaultApproachingMaxFraction
+	}
+	if fraction >= 1 {
+		return math.MaxInt
+	}
+	return int(fraction * math.MaxInt)
+}
+
+func (c *Counter) checkApproachingMax() {
+	if c.OnApproachingMax == nil {
+		return
+	}
+	reached := c.count >= c.approachingMaxThreshold()
+	if reached && !c.approachingMaxFired {
+		c.OnApproachingMax(c.count)
+	}
+	c.approachingMaxFired = reached
+}
 
-func (c *Counter) dec()      { c.count-- }
-func (c *Counter) inc()      { c.count++ }
-func (c *Counter) add(i int) { c.count += i }
-func (c *Counter) sub(i int) { c.count -= i }
-func (c *Counter) set(i int) { c.count = i }
+// SetApproachingMaxFraction sets the fraction of math.MaxInt at which OnApproachingMax is called.
+// DefaultApproachingMaxFraction is used if it was not set
+func (c *Counter) SetApproachingMaxFraction(fraction float64) {
+	c.Lock()
+	defer c.Unlock()
+	c.approachingMaxFraction = fraction
+}
 
 // Inc increases counter by 1. Returns original value
 func (c *Counter) Inc() int {
@@ -38,6 +223,39 @@ func (c *Counter) Add(i int) int {
 	return v
 }
 
+// Sub subtracts i from counter. Returns original value
+func (c *Counter) Sub(i int) int {
+	c.Lock()
+	defer c.Unlock()
+	v := c.count
+	c.sub(i)
+	return v
+}
+
+// AddAll adds all deltas to counter at once. Returns resulting value
+func (c *Counter) AddAll(deltas ...int) int {
+	c.Lock()
+	defer c.Unlock()
+	sum := 0
+	for _, delta := range deltas {
+		sum += delta
+	}
+	c.add(sum)
+	return c.count
+}
+
+// TryAdd adds i to counter only if the result doesn't violate the bounds of a bounded counter.
+// Returns resulting value and true, or the unchanged value and false
+func (c *Counter) TryAdd(i int) (int, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if v := c.count + i; c.clamp(v) != v {
+		return c.count, false
+	}
+	c.add(i)
+	return c.count, true
+}
+
 // Dec decreases counter by 1. Returns original value
 func (c *Counter) Dec() int {
 	c.Lock()
@@ -47,6 +265,33 @@ func (c *Counter) Dec() int {
 	return v
 }
 
+// TryDec decreases counter by 1 only if it doesn't go below zero, or below min for a bounded counter.
+// Returns resulting value, or the unchanged value and ErrCounterUnderflow
+func (c *Counter) TryDec() (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.count-1 < c.floor() {
+		return c.count, ErrCounterUnderflow
+	}
+	c.dec()
+	return c.count, nil
+}
+
+// TrySub subtracts n from counter only if it doesn't go below zero, or below min for a bounded counter.
+// Returns resulting value, or the unchanged value and ErrCounterUnderflow, or ErrNegativeAmount if n is negative
+func (c *Counter) TrySub(n int) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	if n < 0 {
+		return c.count, ErrNegativeAmount
+	}
+	if c.count-n < c.floor() {
+		return c.count, ErrCounterUnderflow
+	}
+	c.sub(n)
+	return c.count, nil
+}
+
 // Set counter to i. Returns original value
 func (c *Counter) Set(i int) int {
 	c.Lock()
@@ -56,6 +301,107 @@ func (c *Counter) Set(i int) int {
 	return v
 }
 
+// CompareAndSwap sets counter to new only if its value equals old. Returns whether it was set
+func (c *Counter) CompareAndSwap(old, new int) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.count != old {
+		return false
+	}
+	c.update("CompareAndSwap", new)
+	return true
+}
+
+// Swap sets counter to new. Returns original value
+func (c *Counter) Swap(new int) int {
+	c.Lock()
+	defer c.Unlock()
+	v := c.count
+	c.update("Swap", new)
+	return v
+}
+
+// UpdateMax sets counter to v if v is greater than the current value. Returns resulting value
+func (c *Counter) UpdateMax(v int) int {
+	c.Lock()
+	defer c.Unlock()
+	if v > c.count {
+		c.set(v)
+	}
+	return c.count
+}
+
+// UpdateMin sets counter to v if v is less than the current value. Returns resulting value
+func (c *Counter) UpdateMin(v int) int {
+	c.Lock()
+	defer c.Unlock()
+	if v < c.count {
+		c.set(v)
+	}
+	return c.count
+}
+
+// Release subtracts n from counter clamping it at zero, or at min for a bounded counter.
+// Negative n is treated as 0. Returns resulting value
+func (c *Counter) Release(n int) int {
+	c.Lock()
+	defer c.Unlock()
+	if n > c.count-c.floor() {
+		n = c.count - c.floor()
+	}
+	if n < 0 {
+		n = 0
+	}
+	c.sub(n)
+	return c.count
+}
+
+// TryAcquire subtracts n from counter only if at least n is available above zero, or above min
+// for a bounded counter. Returns whether it was subtracted, negative n is never subtracted
+func (c *Counter) TryAcquire(n int) bool {
+	c.Lock()
+	defer c.Unlock()
+	if n < 0 || c.count-n < c.floor() {
+		return false
+	}
+	c.sub(n)
+	return true
+}
+
+// lockWith locks both c and other in the order of their addresses to avoid deadlocks.
+// Returns a function unlocking them
+func (c *Counter) lockWith(other *Counter) (unlock func()) {
+	if c == other {
+		c.Lock()
+		return c.Unlock
+	}
+	first, second := c, other
+	if uintptr(unsafe.Pointer(second)) < uintptr(unsafe.Pointer(first)) {
+		first, second = second, first
+	}
+	first.Lock()
+	second.Lock()
+	return func() {
+		second.Unlock()
+		first.Unlock()
+	}
+}
+
+// AddFrom adds the current value of other counter to counter. Returns resulting value
+func (c *Counter) AddFrom(other *Counter) int {
+	defer c.lockWith(other)()
+	c.add(other.count)
+	return c.count
+}
+
+// CopyFrom sets counter to the current value of other counter. Returns original value
+func (c *Counter) CopyFrom(other *Counter) int {
+	defer c.lockWith(other)()
+	v := c.count
+	c.set(other.count)
+	return v
+}
+
 // Get returns current counter value
 func (c *Counter) Get() int {
 	c.Lock()
@@ -63,21 +409,85 @@ func (c *Counter) Get() int {
 	return c.count
 }
 
+// CounterSnapshot is a counter value captured at some moment
+type CounterSnapshot struct {
+	Value int
+	Taken time.Time
+}
+
+// Snapshot captures current counter value
+func (c *Counter) Snapshot() CounterSnapshot {
+	c.Lock()
+	defer c.Unlock()
+	return CounterSnapshot{Value: c.count, Taken: time.Now()}
+}
+
+// DeltaSince returns the difference between current counter value and the value captured by s
+func (c *Counter) DeltaSince(s CounterSnapshot) int {
+	c.Lock()
+	defer c.Unlock()
+	return c.count - s.Value
+}
+
+// IsZero returns true if counter value is zero. It allows omitting counter with omitzero JSON tag option
+func (c *Counter) IsZero() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.count == 0
+}
+
+// String implements fmt.Stringer
+func (c *Counter) String() string { return strconv.Itoa(c.Get()) }
+
+// FormatWith returns the counter value divided by divisor with up to 2 decimals, followed by unit,
+// e.g. "1.5 MB" for 1572864 formatted with unit "MB" and divisor 1 << 20. Divisor less than 1 is treated as 1
+func (c *Counter) FormatWith(unit string, divisor int) string {
+	if divisor < 1 {
+		divisor = 1
+	}
+	v := strconv.FormatFloat(float64(c.Get())/float64(divisor), 'f', 2, 64)
+	v = strings.TrimRight(strings.TrimRight(v, "0"), ".")
+	if unit == "" {
+		return v
+	}
+	return v + " " + unit
+}
+
+// namedCounter is a JSON representation of a named counter
+type namedCounter struct {
+	Name  string `json:"name"`
+	Value int    `json:"value"`
+}
+
 // MarshalJSON implements json.Marshaler
 func (c *Counter) MarshalJSON() ([]byte, error) {
 	c.Lock()
 	defer c.Unlock()
+	if c.name != "" {
+		return json.Marshal(namedCounter{Name: c.name, Value: c.count})
+	}
 	return json.Marshal(c.count)
 }
 
-// UnmarshalJSON implements json.Unmarshaler
+// UnmarshalJSON implements json.Unmarshaler. It accepts both a number and an object of a named counter
 func (c *Counter) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var named namedCounter
+		if err := json.Unmarshal(data, &named); err != nil {
+			return err
+		}
+		c.Lock()
+		c.name, c.count = named.Name, c.clamp(named.Value)
+		c.Unlock()
+		return nil
+	}
+
 	var count int
 	if err := json.Unmarshal(data, &count); err != nil {
 		return err
 	}
 	c.Lock()
-	c.count = count
+	c.count = c.clamp(count)
 	c.Unlock()
 	return nil
 }
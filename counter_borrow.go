@@ -0,0 +1,90 @@
+package synced
+
+import (
+	"context"
+	"sync"
+)
+
+// SetCapacity sets the number of permits above which Return doesn't increase counter, 0 means no limit.
+// If capOnOverflow is true Return just doesn't increase counter, otherwise it returns ErrCounterOverflow.
+func (c *Counter) SetCapacity(capacity int, capOnOverflow bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.capacity, c.capOnOverflow = capacity, capOnOverflow
+}
+
+// serveNext passes the turn to the next borrower skipping the cancelled ones
+func (c *Counter) serveNext() {
+	c.servedTicket++
+	for c.cancelled[c.servedTicket] {
+		delete(c.cancelled, c.servedTicket)
+		c.servedTicket++
+	}
+	c.cond.Broadcast()
+}
+
+// Borrow takes a permit decreasing counter by 1, blocking until counter is positive if needed.
+// Blocked borrowers are served in the order they called Borrow.
+// Returns ctx.Err() if ctx is done before a permit was taken.
+func (c *Counter) Borrow(ctx context.Context) error {
+	c.Lock()
+	defer c.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if c.cond == nil {
+		c.cond = sync.NewCond(c)
+	}
+	ticket := c.nextTicket
+	c.nextTicket++
+
+	cond := c.cond
+	var stopC chan struct{}
+	for c.servedTicket != ticket || c.count < 1 {
+		if err := ctx.Err(); err != nil {
+			if c.servedTicket == ticket {
+				c.serveNext()
+			} else {
+				if c.cancelled == nil {
+					c.cancelled = make(map[uint64]bool)
+				}
+				c.cancelled[ticket] = true
+			}
+			return err
+		}
+		// a borrower served immediately doesn't need to watch ctx
+		if stopC == nil {
+			stopC = make(chan struct{})
+			defer close(stopC)
+			go func() {
+				select {
+				case <-ctx.Done():
+					c.Lock()
+					cond.Broadcast()
+					c.Unlock()
+				case <-stopC:
+				}
+			}()
+		}
+		cond.Wait()
+	}
+	c.dec()
+	c.serveNext()
+	return nil
+}
+
+// Return gives a permit back increasing counter by 1 and waking up the borrowers.
+// If counter has reached its capacity, see SetCapacity, it returns ErrCounterOverflow
+// or does nothing depending on the capacity setting.
+func (c *Counter) Return() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.capacity > 0 && c.count >= c.capacity {
+		if c.capOnOverflow {
+			return nil
+		}
+		return ErrCounterOverflow
+	}
+	c.inc()
+	return nil
+}
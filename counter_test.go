@@ -0,0 +1,157 @@
+package synced
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCounterSub(t *testing.T) {
+	c := NewCounter(10)
+	if v := c.Sub(3); v != 10 {
+		t.Fatalf("Sub returned %d, want original value 10", v)
+	}
+	if v := c.Get(); v != 7 {
+		t.Fatalf("Get returned %d, want 7", v)
+	}
+	c.Sub(-3)
+	if v := c.Get(); v != 10 {
+		t.Fatalf("Get returned %d after subtracting negative value, want 10", v)
+	}
+}
+
+// waitBorrowers waits until n borrowers took their tickets
+func waitBorrowers(t *testing.T, c *Counter, n uint64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.Lock()
+		taken := c.nextTicket
+		c.Unlock()
+		if taken >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d borrowers are waiting, want %d", taken, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCounterBorrowFIFO(t *testing.T) {
+	c := NewCounter(0)
+	servedC := make(chan int, 3)
+	for i := 1; i <= 3; i++ {
+		go func(i int) {
+			if err := c.Borrow(context.Background()); err == nil {
+				servedC <- i
+			}
+		}(i)
+		waitBorrowers(t, &c, uint64(i))
+	}
+	for want := 1; want <= 3; want++ {
+		_ = c.Return()
+		if got := <-servedC; got != want {
+			t.Fatalf("borrower %d served, want %d", got, want)
+		}
+	}
+}
+
+func TestCounterBorrowSkipsCancelled(t *testing.T) {
+	c := NewCounter(0)
+	servedC := make(chan int, 3)
+	cancelledC := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	borrow := func(ctx context.Context, i int) {
+		err := c.Borrow(ctx)
+		if err != nil {
+			cancelledC <- err
+			return
+		}
+		servedC <- i
+	}
+	go borrow(context.Background(), 1)
+	waitBorrowers(t, &c, 1)
+	go borrow(ctx, 2)
+	waitBorrowers(t, &c, 2)
+	go borrow(context.Background(), 3)
+	waitBorrowers(t, &c, 3)
+
+	cancel()
+	if err := <-cancelledC; err != context.Canceled {
+		t.Fatalf("cancelled borrower got %v, want %v", err, context.Canceled)
+	}
+	for _, want := range []int{1, 3} {
+		_ = c.Return()
+		if got := <-servedC; got != want {
+			t.Fatalf("borrower %d served, want %d", got, want)
+		}
+	}
+	if v := c.Get(); v != 0 {
+		t.Fatalf("counter is %d, want 0", v)
+	}
+}
+
+func TestCounterBorrowAvailable(t *testing.T) {
+	c := NewCounter(1)
+	if err := c.Borrow(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if v := c.Get(); v != 0 {
+		t.Fatalf("counter is %d, want 0", v)
+	}
+}
+
+func TestBoundedCounterTryDecrease(t *testing.T) {
+	c := NewBoundedCounter(3, 2, 10)
+	if v, err := c.TryDec(); v != 2 || err != nil {
+		t.Fatalf("TryDec returned %d, %v, want 2", v, err)
+	}
+	if v, err := c.TryDec(); v != 2 || err != ErrCounterUnderflow {
+		t.Fatalf("TryDec at min returned %d, %v, want 2, %v", v, err, ErrCounterUnderflow)
+	}
+	c.Set(5)
+	if v, err := c.TrySub(4); v != 5 || err != ErrCounterUnderflow {
+		t.Fatalf("TrySub past min returned %d, %v, want 5, %v", v, err, ErrCounterUnderflow)
+	}
+	if v, err := c.TrySub(-1); v != 5 || err != ErrNegativeAmount {
+		t.Fatalf("TrySub of negative amount returned %d, %v, want 5, %v", v, err, ErrNegativeAmount)
+	}
+	if c.TryAcquire(4) || c.TryAcquire(-1) {
+		t.Fatalf("TryAcquire succeeded past min or with negative amount, value %d", c.Get())
+	}
+	if v := c.Release(10); v != 2 {
+		t.Fatalf("Release returned %d, want 2 clamped at min", v)
+	}
+	if v := c.Release(-1); v != 2 {
+		t.Fatalf("Release of negative amount returned %d, want 2", v)
+	}
+}
+
+func TestTickerIntervalsClamped(t *testing.T) {
+	bc := NewBucketedCounter(0, -time.Second)
+	defer bc.Close()
+	if w := bc.Window(); w != minTickInterval {
+		t.Fatalf("Window %s, want one bucket of %s", w, minTickInterval)
+	}
+
+	ticked := make(chan int, 1)
+	ic := NewIntervalCounter(0, func(count int) {
+		select {
+		case ticked <- count:
+		default:
+		}
+	})
+	defer ic.Close()
+	select {
+	case <-ticked:
+	case <-time.After(time.Second):
+		t.Fatal("interval counter with non-positive interval never ticked")
+	}
+
+	q := NewQueue()
+	q.StartSampler(0, 0)
+	q.StartExpirySweeper(-time.Second)
+	q.StopExpirySweeper()
+	q.StopSampler()
+}
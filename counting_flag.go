@@ -0,0 +1,72 @@
+package synced
+
+import (
+	"context"
+	"sync"
+)
+
+// CountingFlag is a thread-safe flag that is set while it has at least one holder
+type CountingFlag struct {
+	count  int
+	unsetC chan struct{} // closed when the last holder releases the flag
+	sync.Mutex
+}
+
+// NewCountingFlag returns a new unset counting flag
+func NewCountingFlag() *CountingFlag { return &CountingFlag{} }
+
+// Acquire adds a holder to the flag, setting it
+func (f *CountingFlag) Acquire() {
+	f.Lock()
+	defer f.Unlock()
+	f.count++
+	if f.count == 1 {
+		f.unsetC = make(chan struct{})
+	}
+}
+
+// Release removes a holder from the flag. The flag is unset when the last holder releases it.
+// Releasing an unset flag does nothing.
+func (f *CountingFlag) Release() {
+	f.Lock()
+	defer f.Unlock()
+	if f.count == 0 {
+		return
+	}
+	f.count--
+	if f.count == 0 {
+		close(f.unsetC)
+	}
+}
+
+// Get returns true if the flag has at least one holder
+func (f *CountingFlag) Get() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.count > 0
+}
+
+// Count returns current number of holders
+func (f *CountingFlag) Count() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.count
+}
+
+// WaitUntilUnset blocks until the flag has no holders or ctx is done. Returns ctx.Err() in the latter case
+func (f *CountingFlag) WaitUntilUnset(ctx context.Context) error {
+	f.Lock()
+	if f.count == 0 {
+		f.Unlock()
+		return nil
+	}
+	unsetC := f.unsetC
+	f.Unlock()
+
+	select {
+	case <-unsetC:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
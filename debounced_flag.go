@@ -0,0 +1,102 @@
+package synced
+
+import (
+	"sync"
+	"time"
+)
+
+// DebouncedFlag is a thread-safe flag whose state change takes effect only after the new state
+// was requested for the debounce duration without a contrary change
+type DebouncedFlag struct {
+	state   bool
+	pending bool
+	timer   *time.Timer
+	seq     uint64 // identifies the current pending change
+	d       time.Duration
+	closed  bool
+	sync.Mutex
+
+	// OnChange is called with the new state each time a state change takes effect.
+	// It is called synchronously by the debounce timer goroutine after the flag is unlocked.
+	OnChange func(state bool)
+}
+
+// NewDebouncedFlag returns a pointer to a new unset debounced flag with debounce duration d.
+// Close should be called to stop the pending change timer.
+func NewDebouncedFlag(d time.Duration) *DebouncedFlag { return &DebouncedFlag{d: d} }
+
+// Set requests setting the flag
+func (f *DebouncedFlag) Set() { f.SetState(true) }
+
+// Unset requests unsetting the flag
+func (f *DebouncedFlag) Unset() { f.SetState(false) }
+
+// SetState requests the flag state. It takes effect after the debounce duration unless a contrary state
+// is requested meanwhile, which cancels the pending change. Requesting the pending state again
+// doesn't restart the debounce duration. It does nothing after Close.
+func (f *DebouncedFlag) SetState(state bool) {
+	f.Lock()
+	defer f.Unlock()
+	if f.closed {
+		return
+	}
+	if f.timer != nil {
+		if f.pending == state {
+			return
+		}
+		f.cancel()
+	}
+	if f.state == state {
+		return
+	}
+
+	f.pending = state
+	f.seq++
+	seq := f.seq
+	f.timer = time.AfterFunc(f.d, func() { f.commit(seq) })
+}
+
+// cancel cancels a pending change. f must be locked
+func (f *DebouncedFlag) cancel() {
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	f.seq++
+}
+
+// commit applies the pending change identified by seq if it was not cancelled
+func (f *DebouncedFlag) commit(seq uint64) {
+	f.Lock()
+	if f.seq != seq || f.closed {
+		f.Unlock()
+		return
+	}
+	f.timer = nil
+	f.state = f.pending
+	state, onChange := f.state, f.OnChange
+	f.Unlock()
+	notifyChange(onChange, state)
+}
+
+// Get returns current flag state
+func (f *DebouncedFlag) Get() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.state
+}
+
+// Pending returns the requested state and true if a state change is pending
+func (f *DebouncedFlag) Pending() (state bool, ok bool) {
+	f.Lock()
+	defer f.Unlock()
+	return f.pending, f.timer != nil
+}
+
+// Close cancels a pending change
+func (f *DebouncedFlag) Close() {
+	f.Lock()
+	defer f.Unlock()
+	f.cancel()
+	f.closed = true
+}
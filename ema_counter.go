@@ -0,0 +1,48 @@
+package synced
+
+import "sync"
+
+// EMACounter is a thread-safe exponential moving average of observed values
+type EMACounter struct {
+	alpha    float64
+	value    float64
+	observed bool
+	sync.Mutex
+}
+
+// NewEMACounter returns a pointer to a new moving average with smoothing factor alpha.
+// Larger alpha discounts older observations faster. Alpha out of (0, 1] is treated as 1
+func NewEMACounter(alpha float64) *EMACounter {
+	if alpha <= 0 || alpha > 1 {
+		alpha = 1
+	}
+	return &EMACounter{alpha: alpha}
+}
+
+// Observe updates the moving average with v. The first observation initializes it. Returns resulting value
+func (c *EMACounter) Observe(v float64) float64 {
+	c.Lock()
+	defer c.Unlock()
+	if !c.observed {
+		c.value, c.observed = v, true
+		return c.value
+	}
+	c.value += c.alpha * (v - c.value)
+	return c.value
+}
+
+// Value returns the moving average, 0 if nothing was observed
+func (c *EMACounter) Value() float64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.value
+}
+
+// Reset discards the observations. Returns the moving average before the reset
+func (c *EMACounter) Reset() float64 {
+	c.Lock()
+	defer c.Unlock()
+	v := c.value
+	c.value, c.observed = 0, false
+	return v
+}
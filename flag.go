@@ -1,38 +1,190 @@
 package synced
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"sync"
 )
 
 // Flag that is thread-safe
 type Flag struct {
-	state bool
+	state      bool
+	generation uint64
+	name       string
+	reason     string
+	cond       *sync.Cond // broadcasted on the flag state changes
+	pulses     uint64     // number of Pulse calls, to pass waiters through a pulse
 	sync.Mutex
+
+	// OnChange is called with the new state each time the flag state changes.
+	// It is called synchronously by the changing goroutine after the flag is unlocked.
+	OnChange func(state bool)
+	// OnChangeWithReason is called like OnChange, after it, along with the reason of the change
+	OnChangeWithReason func(state bool, reason string)
 }
 
 // NewFlag returns a new synced flag initialized by initialValue
-func NewFlag(initialState bool) Flag { return Flag{initialState, sync.Mutex{}} }
+func NewFlag(initialState bool) Flag { return Flag{state: initialState} }
 
-// Set the flag
-func (f *Flag) Set() {
+// NewNamedFlag returns a new synced flag named by name initialized by initialValue.
+// Named flag is marshaled to JSON as an object holding both name and state.
+func NewNamedFlag(name string, initialState bool) Flag { return Flag{state: initialState, name: name} }
+
+// Name returns the flag name
+func (f *Flag) Name() string {
 	f.Lock()
-	f.state = true
-	f.Unlock()
+	defer f.Unlock()
+	return f.name
 }
 
+// setState sets the flag state without a reason, see setStateWithReason
+func (f *Flag) setState(state bool) func(state bool) { return f.setStateWithReason(state, "") }
+
+// setStateWithReason sets the flag state and the reason of the change. Returns the change callbacks
+// to be called after unlocking or nil if the state was not changed
+func (f *Flag) setStateWithReason(state bool, reason string) func(state bool) {
+	if f.state == state {
+		return nil
+	}
+	f.state, f.reason = state, reason
+	f.generation++
+	if f.cond != nil {
+		f.cond.Broadcast()
+	}
+	onChange, onChangeWithReason := f.OnChange, f.OnChangeWithReason
+	if onChangeWithReason == nil {
+		return onChange
+	}
+	return func(state bool) {
+		if onChange != nil {
+			onChange(state)
+		}
+		onChangeWithReason(state, reason)
+	}
+}
+
+// notifyChange calls onChange with state if it is not nil. Returns whether it was called
+func notifyChange(onChange func(state bool), state bool) bool {
+	if onChange == nil {
+		return false
+	}
+	onChange(state)
+	return true
+}
+
+// Set the flag
+func (f *Flag) Set() { f.SetState(true) }
+
 // SetState of the flag
 func (f *Flag) SetState(state bool) {
 	f.Lock()
-	f.state = state
+	onChange := f.setState(state)
 	f.Unlock()
+	notifyChange(onChange, state)
 }
 
 // Unset the flag
-func (f *Flag) Unset() {
+func (f *Flag) Unset() { f.SetState(false) }
+
+// SetWithReason sets the flag recording the reason of the change, see Reason
+func (f *Flag) SetWithReason(reason string) { f.SetStateWithReason(true, reason) }
+
+// UnsetWithReason unsets the flag recording the reason of the change, see Reason
+func (f *Flag) UnsetWithReason(reason string) { f.SetStateWithReason(false, reason) }
+
+// SetStateWithReason sets the flag state recording the reason of the change, see Reason.
+// The reason is not recorded if the state is not changed
+func (f *Flag) SetStateWithReason(state bool, reason string) {
+	f.Lock()
+	onChange := f.setStateWithReason(state, reason)
+	f.Unlock()
+	notifyChange(onChange, state)
+}
+
+// Reason returns the reason of the last flag state change, empty if it was changed without a reason
+func (f *Flag) Reason() string {
+	f.Lock()
+	defer f.Unlock()
+	return f.reason
+}
+
+// ToggleAndNotify flips the flag. Returns the new state and whether OnChange was called,
+// which happens before ToggleAndNotify returns
+func (f *Flag) ToggleAndNotify() (newState bool, changed bool) {
 	f.Lock()
-	f.state = false
+	newState = !f.state
+	onChange := f.setState(newState)
 	f.Unlock()
+	return newState, notifyChange(onChange, newState)
+}
+
+// Toggle flips the flag. Returns the new state
+func (f *Flag) Toggle() bool {
+	newState, _ := f.ToggleAndNotify()
+	return newState
+}
+
+// CompareAndSwap sets the flag state to new only if the current state equals old. Returns whether it was set
+func (f *Flag) CompareAndSwap(old, new bool) bool {
+	f.Lock()
+	if f.state != old {
+		f.Unlock()
+		return false
+	}
+	onChange := f.setState(new)
+	f.Unlock()
+	notifyChange(onChange, new)
+	return true
+}
+
+// Pulse sets the flag and immediately unsets it as one atomic edge: the flag is never seen set
+// by the readers, but the generation grows by 2, goroutines blocked in PassThrough pass through,
+// and OnChange is called for both transitions in order. Does nothing if the flag is set already.
+func (f *Flag) Pulse() {
+	f.Lock()
+	if f.state {
+		f.Unlock()
+		return
+	}
+	onSet := f.setState(true)
+	onUnset := f.setState(false)
+	f.pulses++
+	f.Unlock()
+	notifyChange(onSet, true)
+	notifyChange(onUnset, false)
+}
+
+// PassThrough returns immediately if the flag is set, otherwise it blocks until the flag is set or pulsed,
+// so the flag works as a gate paused by Unset and resumed by Set. Returns ctx.Err() if ctx is done before
+func (f *Flag) PassThrough(ctx context.Context) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.state {
+		return nil
+	}
+	if f.cond == nil {
+		f.cond = sync.NewCond(f)
+	}
+	cond, pulses := f.cond, f.pulses
+	stopC := make(chan struct{})
+	defer close(stopC)
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.Lock()
+			cond.Broadcast()
+			f.Unlock()
+		case <-stopC:
+		}
+	}()
+	for !f.state && f.pulses == pulses {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		cond.Wait()
+	}
+	return nil
 }
 
 // Get returns current flag state
@@ -42,21 +194,69 @@ func (f *Flag) Get() bool {
 	return f.state
 }
 
+// GetAndClear unsets the flag and returns its previous state
+func (f *Flag) GetAndClear() bool {
+	f.Lock()
+	state := f.state
+	onChange := f.setState(false)
+	f.Unlock()
+	notifyChange(onChange, false)
+	return state
+}
+
+// namedFlag is a JSON representation of a named flag
+type namedFlag struct {
+	Name  string `json:"name"`
+	State bool   `json:"state"`
+}
+
+// Generation returns the number of the flag state changes. A consumer may compare it with the value
+// got earlier to detect the flag changes even if the state returned to the same value.
+func (f *Flag) Generation() uint64 {
+	f.Lock()
+	defer f.Unlock()
+	return f.generation
+}
+
+// GetWithGeneration returns current flag state along with its generation, see Generation
+func (f *Flag) GetWithGeneration() (bool, uint64) {
+	f.Lock()
+	defer f.Unlock()
+	return f.state, f.generation
+}
+
 // MarshalJSON implements json.Marshaler
 func (f *Flag) MarshalJSON() ([]byte, error) {
 	f.Lock()
 	defer f.Unlock()
+	if f.name != "" {
+		return json.Marshal(namedFlag{Name: f.name, State: f.state})
+	}
 	return json.Marshal(f.state)
 }
 
-// UnmarshalJSON implements json.Unmarshaler
+// UnmarshalJSON implements json.Unmarshaler. It accepts both a bool and an object of a named flag
 func (f *Flag) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var named namedFlag
+		if err := json.Unmarshal(data, &named); err != nil {
+			return err
+		}
+		f.Lock()
+		f.name = named.Name
+		onChange := f.setState(named.State)
+		f.Unlock()
+		notifyChange(onChange, named.State)
+		return nil
+	}
+
 	var state bool
 	if err := json.Unmarshal(data, &state); err != nil {
 		return err
 	}
 	f.Lock()
-	f.state = state
+	onChange := f.setState(state)
 	f.Unlock()
+	notifyChange(onChange, state)
 	return nil
 }
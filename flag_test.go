@@ -0,0 +1,50 @@
+package synced
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestFlagConcurrentToggle(t *testing.T) {
+	f := NewFlag(false)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.Toggle()
+		}()
+	}
+	wg.Wait()
+	if f.Get() {
+		t.Fatal("flag is set after an even number of toggles")
+	}
+	if g := f.Generation(); g != 100 {
+		t.Fatalf("generation is %d, want 100", g)
+	}
+}
+
+func TestFlagCompareAndSwapOnce(t *testing.T) {
+	f := NewFlag(false)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	swapped := 0
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if f.CompareAndSwap(false, true) {
+				mu.Lock()
+				swapped++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if swapped != 1 || !f.Get() {
+		t.Fatalf("swapped %d times, flag %v, want 1 swap to true", swapped, f.Get())
+	}
+	if f.CompareAndSwap(false, true) {
+		t.Fatal("CompareAndSwap swapped with a mismatching old state")
+	}
+}
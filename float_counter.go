@@ -0,0 +1,62 @@
+package synced
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// FloatCounter is a thread-safe float64 counter, e.g. to accumulate metrics
+type FloatCounter struct {
+	value float64
+	sync.Mutex
+}
+
+// NewFloatCounter returns a new synced float counter initialized by initialValue
+func NewFloatCounter(initialValue float64) FloatCounter { return FloatCounter{value: initialValue} }
+
+// Inc increases counter by 1. Returns original value
+func (c *FloatCounter) Inc() float64 { return c.Add(1) }
+
+// Dec decreases counter by 1. Returns original value
+func (c *FloatCounter) Dec() float64 { return c.Add(-1) }
+
+// Add i to counter. Returns original value
+func (c *FloatCounter) Add(i float64) float64 {
+	c.Lock()
+	defer c.Unlock()
+	v := c.value
+	c.value += i
+	return v
+}
+
+// Sub subtracts i from counter. Returns original value
+func (c *FloatCounter) Sub(i float64) float64 { return c.Add(-i) }
+
+// Set counter to i. Returns original value
+func (c *FloatCounter) Set(i float64) float64 {
+	c.Lock()
+	defer c.Unlock()
+	v := c.value
+	c.value = i
+	return v
+}
+
+// Get returns current counter value
+func (c *FloatCounter) Get() float64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.value
+}
+
+// MarshalJSON implements json.Marshaler
+func (c *FloatCounter) MarshalJSON() ([]byte, error) { return json.Marshal(c.Get()) }
+
+// UnmarshalJSON implements json.Unmarshaler
+func (c *FloatCounter) UnmarshalJSON(data []byte) error {
+	var value float64
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	c.Set(value)
+	return nil
+}
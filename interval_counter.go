@@ -0,0 +1,75 @@
+package synced
+
+import (
+	"sync"
+	"time"
+)
+
+// IntervalCounter is a thread-safe counter delivering its value to a callback and resetting to zero
+// every interval
+type IntervalCounter struct {
+	count     int
+	onTick    func(count int)
+	ticker    *time.Ticker
+	closeC    chan struct{}
+	closeOnce sync.Once
+	sync.Mutex
+}
+
+// NewIntervalCounter returns a pointer to a new interval counter calling onTick with the value
+// accumulated during each interval. Close should be called to stop ticking.
+// An interval shorter than a millisecond, including a non-positive one, is raised to a millisecond.
+func NewIntervalCounter(interval time.Duration, onTick func(count int)) *IntervalCounter {
+	c := &IntervalCounter{
+		onTick: onTick,
+		ticker: time.NewTicker(clampInterval(interval)),
+		closeC: make(chan struct{}),
+	}
+	go func() {
+		for {
+			select {
+			case <-c.ticker.C:
+				c.tick()
+			case <-c.closeC:
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// tick resets the counter and calls onTick with the value it had, after unlocking
+func (c *IntervalCounter) tick() {
+	c.Lock()
+	count := c.count
+	c.count = 0
+	c.Unlock()
+	if c.onTick != nil {
+		c.onTick(count)
+	}
+}
+
+// Inc increases counter of the current interval by 1
+func (c *IntervalCounter) Inc() { c.Add(1) }
+
+// Add i to counter of the current interval
+func (c *IntervalCounter) Add(i int) {
+	c.Lock()
+	defer c.Unlock()
+	c.count += i
+}
+
+// Get returns the value accumulated during the current interval so far
+func (c *IntervalCounter) Get() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.count
+}
+
+// Close stops ticking. The value accumulated during the current interval is not delivered
+func (c *IntervalCounter) Close() {
+	c.closeOnce.Do(func() {
+		c.ticker.Stop()
+		close(c.closeC)
+	})
+}
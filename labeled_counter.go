@@ -0,0 +1,130 @@
+package synced
+
+import (
+	"sort"
+	"sync"
+)
+
+// LabeledCounter is a thread-safe set of integer counters distinguished by labels
+type LabeledCounter struct {
+	counts map[string]int
+	sync.Mutex
+}
+
+// NewLabeledCounter returns a pointer to a new empty labeled counter
+func NewLabeledCounter() *LabeledCounter {
+	return &LabeledCounter{counts: make(map[string]int)}
+}
+
+// add i to the counter with the given label. Returns the new value
+func (c *LabeledCounter) add(label string, i int) int {
+	c.counts[label] += i
+	return c.counts[label]
+}
+
+// Inc increments the counter with the given label. Returns the new value
+func (c *LabeledCounter) Inc(label string) int {
+	c.Lock()
+	defer c.Unlock()
+	return c.add(label, 1)
+}
+
+// Add i to the counter with the given label. Returns the new value
+func (c *LabeledCounter) Add(label string, i int) int {
+	c.Lock()
+	defer c.Unlock()
+	return c.add(label, i)
+}
+
+// IncMany increments the counter of each given label under a single lock.
+// A label repeated several times is incremented several times
+func (c *LabeledCounter) IncMany(labels ...string) {
+	c.Lock()
+	defer c.Unlock()
+	for _, label := range labels {
+		c.add(label, 1)
+	}
+}
+
+// AddMany adds values of m to the counters with corresponding labels under a single lock
+func (c *LabeledCounter) AddMany(m map[string]int) {
+	c.Lock()
+	defer c.Unlock()
+	for label, i := range m {
+		c.add(label, i)
+	}
+}
+
+// ProportionalSplit distributes total across the counters proportionally to their current positive values
+// and adds the allocations to them, all under a single lock. Allocations sum up to total exactly,
+// the remainder of rounding goes to the counters with the largest fractional parts, ties are broken
+// by label order. Returns the allocations by labels, or nil if there are no positive counters.
+func (c *LabeledCounter) ProportionalSplit(total int) map[string]int {
+	c.Lock()
+	defer c.Unlock()
+	weight := 0
+	labels := make([]string, 0, len(c.counts))
+	for label, v := range c.counts {
+		if v > 0 {
+			weight += v
+			labels = append(labels, label)
+		}
+	}
+	if weight == 0 {
+		return nil
+	}
+	sort.Strings(labels)
+
+	allocations := make(map[string]int, len(labels))
+	remainders := make(map[string]int, len(labels))
+	allocated := 0
+	for _, label := range labels {
+		share := total * c.counts[label]
+		allocations[label], remainders[label] = share/weight, share%weight
+		allocated += allocations[label]
+	}
+	sort.SliceStable(labels, func(i, j int) bool { return remainders[labels[i]] > remainders[labels[j]] })
+	step := 1
+	if total < 0 {
+		step = -1
+		sort.SliceStable(labels, func(i, j int) bool { return remainders[labels[i]] < remainders[labels[j]] })
+	}
+	for i := 0; allocated != total; i++ {
+		allocations[labels[i]] += step
+		allocated += step
+	}
+	for label, n := range allocations {
+		c.add(label, n)
+	}
+	return allocations
+}
+
+// Get returns the value of the counter with the given label, 0 if there is no such label
+func (c *LabeledCounter) Get(label string) int {
+	c.Lock()
+	defer c.Unlock()
+	return c.counts[label]
+}
+
+// Labels returns sorted labels of the counters
+func (c *LabeledCounter) Labels() []string {
+	c.Lock()
+	defer c.Unlock()
+	labels := make([]string, 0, len(c.counts))
+	for label := range c.counts {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// Snapshot returns a copy of all counters by labels
+func (c *LabeledCounter) Snapshot() map[string]int {
+	c.Lock()
+	defer c.Unlock()
+	m := make(map[string]int, len(c.counts))
+	for label, v := range c.counts {
+		m[label] = v
+	}
+	return m
+}
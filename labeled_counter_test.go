@@ -0,0 +1,71 @@
+package synced
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestLabeledCounterProportionalSplitRemainder(t *testing.T) {
+	c := NewLabeledCounter()
+	c.AddMany(map[string]int{"a": 1, "b": 1, "c": 1})
+	allocations := c.ProportionalSplit(10)
+	// 10/3 leaves the remainder of 1, which goes to the first label as all fractional parts are equal
+	if allocations["a"] != 4 || allocations["b"] != 3 || allocations["c"] != 3 {
+		t.Fatalf("allocations %v, want a:4 b:3 c:3", allocations)
+	}
+	if v := c.Get("a"); v != 5 {
+		t.Fatalf("counter a is %d after split, want 5", v)
+	}
+}
+
+func TestLabeledCounterProportionalSplitZeroTotal(t *testing.T) {
+	c := NewLabeledCounter()
+	c.AddMany(map[string]int{"a": 2, "b": 3})
+	for label, n := range c.ProportionalSplit(0) {
+		if n != 0 {
+			t.Fatalf("allocation %d to %s of zero total", n, label)
+		}
+	}
+	if c.Get("a") != 2 || c.Get("b") != 3 {
+		t.Fatalf("counters changed by zero total split: a=%d b=%d", c.Get("a"), c.Get("b"))
+	}
+}
+
+func TestLabeledCounterProportionalSplitNonPositiveWeights(t *testing.T) {
+	c := NewLabeledCounter()
+	c.AddMany(map[string]int{"neg": -5, "zero": 0})
+	if allocations := c.ProportionalSplit(10); allocations != nil {
+		t.Fatalf("allocations %v without positive counters, want nil", allocations)
+	}
+	c.Add("pos", 1)
+	allocations := c.ProportionalSplit(10)
+	if len(allocations) != 1 || allocations["pos"] != 10 {
+		t.Fatalf("allocations %v, want all 10 to the only positive counter", allocations)
+	}
+	if c.Get("neg") != -5 {
+		t.Fatalf("negative counter changed to %d", c.Get("neg"))
+	}
+}
+
+func TestLabeledCounterProportionalSplitSumsToTotal(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	labels := []string{"a", "b", "c", "d", "e"}
+	for i := 0; i < 1000; i++ {
+		c := NewLabeledCounter()
+		for _, label := range labels {
+			c.Add(label, r.Intn(20)-5)
+		}
+		total := r.Intn(2001) - 1000
+		allocations := c.ProportionalSplit(total)
+		if allocations == nil {
+			continue
+		}
+		sum := 0
+		for _, n := range allocations {
+			sum += n
+		}
+		if sum != total {
+			t.Fatalf("allocations %v sum up to %d, want %d", allocations, sum, total)
+		}
+	}
+}
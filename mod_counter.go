@@ -0,0 +1,58 @@
+package synced
+
+import "sync"
+
+// ModCounter is a thread-safe counter wrapping around at a modulus, e.g. for round-robin
+type ModCounter struct {
+	count int
+	mod   int
+	sync.Mutex
+}
+
+// NewModCounter returns a pointer to a new counter cycling through 0..mod-1. Modulus less than 1 is treated as 1
+func NewModCounter(mod int) *ModCounter {
+	if mod < 1 {
+		mod = 1
+	}
+	return &ModCounter{mod: mod}
+}
+
+// Next returns current value and advances counter modulo the modulus
+func (c *ModCounter) Next() int {
+	c.Lock()
+	defer c.Unlock()
+	v := c.count
+	c.count = (c.count + 1) % c.mod
+	return v
+}
+
+// Inc is an alias of Next
+func (c *ModCounter) Inc() int { return c.Next() }
+
+// Get returns current value
+func (c *ModCounter) Get() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.count
+}
+
+// SetMod sets the modulus, current value is wrapped around to it. Modulus less than 1 is treated as 1.
+// Returns original modulus
+func (c *ModCounter) SetMod(mod int) int {
+	c.Lock()
+	defer c.Unlock()
+	if mod < 1 {
+		mod = 1
+	}
+	v := c.mod
+	c.mod = mod
+	c.count %= mod
+	return v
+}
+
+// Mod returns the modulus
+func (c *ModCounter) Mod() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.mod
+}
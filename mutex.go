@@ -1,61 +1,247 @@
 package synced
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"runtime"
 	"runtime/debug"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
 // Mutex adds debugging-related functionality to sync.Mutex.
 // It is coded on top of sync.RWMutex to minimize code duplication.
 type Mutex struct {
-	mu          sync.RWMutex
-	callbacksMu sync.Mutex
+	mu                sync.RWMutex
+	waiters           int32
+	callbacksMu       sync.Mutex
+	callbacksDisabled int32 // set atomically under callbacksMu, so the disabled lock path doesn't lock callbacksMu
+	name              string
+	panicOnMisuse     bool
+	spin              int
 
-	lockedAt   time.Time
-	lockedAtMu sync.Mutex
-	ticker     *time.Ticker
-	closeC     chan struct{}
+	stopWatch func()
 
-	lockTagMu sync.Mutex
+	lockTagMu sync.Mutex // guards the write lock holder state below
 	lockTag   *string
+	lastTag   *string   // tag of the last released write lock, reported on unlock misuse
+	lockedAt  time.Time // when the write lock was acquired, zero if it is not held
+	writeGen  uint64    // number of the write lock acquisitions
+	holder    uint64    // goroutine ID of the write lock holder if tracked
+	lockStack []byte    // stack trace of the write lock holder if timeout events or goroutine IDs are tracked
+
+	eventsMu   sync.Mutex
+	events     chan TimeoutEvent // nil unless the channel returned by TimeoutEvents is open
+	eventsOpen int32             // set atomically under eventsMu while the events channel is open
+
+	trackGoroutineID bool
+
+	trackWaiters bool
+	waitTimeout  time.Duration
+	waitersMu    sync.Mutex
+	waitStarts   map[uint64]time.Time // wait start times of the blocked waiters by waiter ID
+	lastWaiterID uint64
+
+	traceMu sync.Mutex
+	traceW  io.Writer
+	tracing int32 // set atomically under traceMu while traceW is set
+
+	collectStats bool
+	countPaths   bool
+	statsMu      sync.Mutex
+	stats        MutexStats
+	acquiredAt   time.Time
+	sections     map[string]time.Duration // total hold time of critical sections by name
 
 	BeforeLock         func()
 	AfterLock          func()
 	BeforeUnlock       func()
 	AfterUnlock        func()
 	AfterUnlockRecover func(r interface{})
+
+	// OnTimeout is called by the timeout watchdog each time it finds the mutex locked
+	// for MutexParams.Timeout (MutexParams.ReadTimeout for read locks) or longer.
+	// The watchdog is started by the default callbacks, so it is called only with MutexParams.SetDefaultCallbacks
+	OnTimeout func(e TimeoutEvent)
+	// OnHardTimeout is called once per lock hold by the timeout watchdog
+	// when the mutex is locked for MutexParams.HardTimeout or longer, only with MutexParams.SetDefaultCallbacks
+	OnHardTimeout func()
+	// OnWaitTimeout is called once per lock acquisition with the wait duration
+	// when a goroutine waits for the lock for MutexParams.WaitTimeout or longer
+	OnWaitTimeout func(waited time.Duration)
+	// OnMisuse is called instead of panicking when a lock expectation is violated, e.g. by AssertHeld.
+	// A re-entrant Lock still deadlocks after OnMisuse returns.
+	OnMisuse func(err error)
 }
 
-func printStackTrace(b []byte) { log.Println("StackTrace: " + string(b)) }
+// mutex misuse errors
+var (
+	ErrMutexNotHeld = errors.New("mutex is not held")
+	ErrMutexHeld    = errors.New("mutex is held")
+)
 
-func (m *Mutex) defaultCallback(event, mname string, p MutexParams) {
+// ReentrantLockError is reported on an attempt to lock the mutex by the goroutine already holding it
+type ReentrantLockError struct {
+	Name        string
+	GoroutineID uint64
+	HolderStack []byte // stack trace of the goroutine at the first locking
+	Stack       []byte // stack trace of the goroutine at the re-entrant locking
+}
+
+// Error implements error
+func (e ReentrantLockError) Error() string {
+	return fmt.Sprintf("re-entrant lock on non-reentrant mutex %s by goroutine %d\nHolder stack: %s\nStack: %s",
+		e.Name, e.GoroutineID, e.HolderStack, e.Stack)
+}
+
+// TimeoutEvent describes a lock held longer than the timeout
+type TimeoutEvent struct {
+	Name string
+	Tag  string
+	// Kind is "Lock" for a write lock and "RLock" for a read lock
+	Kind string
+	Held time.Duration
+	// GoroutineID is the ID of the write lock holder goroutine if MutexParams.TrackGoroutineID was set
+	GoroutineID uint64
+	// Stack is the stack trace of the write lock holder at locking, it is set only for events
+	// delivered to the TimeoutEvents channel
+	Stack []byte
+}
+
+// timeoutEventsBufferSize is the buffer size of the TimeoutEvents channel
+const timeoutEventsBufferSize = 16
+
+// TimeoutEvents returns a channel receiving an event each time the timeout watchdog finds the mutex
+// locked for longer than the timeout. Events are dropped if the channel buffer is full, so the watchdog
+// is never blocked by a slow receiver. The watchdog is started by the default callbacks, so events are
+// sent only with MutexParams.SetDefaultCallbacks. The same channel is returned until it is closed
+// with CloseTimeoutEvents, a new one is returned after that.
+func (m *Mutex) TimeoutEvents() <-chan TimeoutEvent {
+	m.eventsMu.Lock()
+	defer m.eventsMu.Unlock()
+	if m.events == nil {
+		m.events = make(chan TimeoutEvent, timeoutEventsBufferSize)
+		atomic.StoreInt32(&m.eventsOpen, 1)
+	}
+	return m.events
+}
+
+// CloseTimeoutEvents closes the channel returned by TimeoutEvents
+func (m *Mutex) CloseTimeoutEvents() {
+	m.eventsMu.Lock()
+	defer m.eventsMu.Unlock()
+	if m.events != nil {
+		close(m.events)
+		m.events = nil
+		atomic.StoreInt32(&m.eventsOpen, 0)
+	}
+}
+
+// haveTimeoutEvents returns true if the TimeoutEvents channel is open
+func (m *Mutex) haveTimeoutEvents() bool { return atomic.LoadInt32(&m.eventsOpen) != 0 }
+
+// sendTimeoutEvent sends e to the TimeoutEvents channel if it is open and not full
+func (m *Mutex) sendTimeoutEvent(e TimeoutEvent) {
+	m.eventsMu.Lock()
+	defer m.eventsMu.Unlock()
+	if m.events == nil {
+		return
+	}
+	select {
+	case m.events <- e:
+	default:
+	}
+}
+
+// unlock misuse descriptions wrapped into UnlockPanic
+const (
+	errUnlockOfUnlocked  = "sync: unlock of unlocked mutex"
+	errRUnlockOfUnlocked = "sync: RUnlock of unlocked RWMutex"
+)
+
+// UnlockPanic is passed to AfterUnlockRecover and AfterRUnlockRecover callbacks on unlocking
+// of the mutex which is not locked. It wraps the misuse description with the name of the mutex.
+type UnlockPanic struct {
+	Name  string
+	Tag   *string // tag of the last released write lock, nil for RUnlock
+	Value interface{}
+}
+
+// String implements fmt.Stringer
+func (p UnlockPanic) String() string {
 	var tagInfo string
-	func() {
-		m.lockTagMu.Lock()
-		defer m.lockTagMu.Unlock()
-		if m.lockTag != nil {
-			tagInfo = fmt.Sprintf(" (tag=%q)", *m.lockTag)
+	if p.Tag != nil {
+		tagInfo = fmt.Sprintf(" (tag=%q)", *p.Tag)
+	}
+	return fmt.Sprintf("%s%s: %v", p.Name, tagInfo, p.Value)
+}
+
+func printStackTrace(b []byte) { log.Println("StackTrace: " + string(b)) }
+
+func printGoroutines(b []byte) { log.Println("Goroutines: " + string(b)) }
+
+// allStacks returns stack traces of all goroutines
+func allStacks() []byte {
+	b := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(b, true)
+		if n < len(b) {
+			return b[:n]
 		}
-	}()
-	log.Printf("%s for %s %s%s", event, mname, p.Name, tagInfo)
+		b = make([]byte, 2*len(b))
+	}
+}
+
+// goroutineID returns the current goroutine ID parsed from its stack trace.
+// It is relatively slow and should be used for debugging only.
+func goroutineID() uint64 {
+	b := make([]byte, 64)
+	b = b[:runtime.Stack(b, false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	var id uint64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0
+		}
+		id = id*10 + uint64(c-'0')
+	}
+	return id
+}
+
+// holderInfo returns the tag of the write lock and the goroutine ID of its holder, parsed once at acquire
+// if it is tracked, formatted for the default callbacks
+func (m *Mutex) holderInfo() string {
+	m.lockTagMu.Lock()
+	defer m.lockTagMu.Unlock()
+	var info string
+	if m.lockTag != nil {
+		info = fmt.Sprintf(" (tag=%q)", *m.lockTag)
+	}
+	if m.holder != 0 {
+		info += fmt.Sprintf(" (goroutine=%d)", m.holder)
+	}
+	return info
+}
+
+func (m *Mutex) defaultCallback(event, mname string, p MutexParams) {
+	log.Printf("%s for %s %s%s", event, mname, p.Name, m.holderInfo())
 	if p.AddStackTrace {
 		printStackTrace(debug.Stack())
 	}
 }
 
 func (m *Mutex) defaultCallback1(event, mname string, p MutexParams, r interface{}) {
-	var tagInfo string
-	func() {
-		m.lockTagMu.Lock()
-		defer m.lockTagMu.Unlock()
-		if m.lockTag != nil {
-			tagInfo = fmt.Sprintf(" (tag=%q)", *m.lockTag)
-		}
-	}()
-	log.Printf("%s for %s %s%s: %v", event, mname, p.Name, tagInfo, r)
+	log.Printf("%s for %s %s%s: %v", event, mname, p.Name, m.holderInfo(), r)
 	if p.AddStackTrace {
 		printStackTrace(debug.Stack())
 	}
@@ -67,70 +253,161 @@ type MutexParams struct {
 	SetDefaultCallbacks bool
 	AddStackTrace       bool
 	Timeout             time.Duration
+	// ReadTimeout is the lock hold duration threshold for RWMutex read locks, Timeout is used if zero
+	ReadTimeout time.Duration
+	// HardTimeout is the second, larger threshold of the lock hold duration after which
+	// the watchdog calls OnHardTimeout
+	HardTimeout time.Duration
+	// DumpGoroutines makes the watchdog log stack traces of all goroutines on HardTimeout
+	DumpGoroutines bool
+	// TrackGoroutineID enables tracking the ID of the goroutine holding the write lock and adds
+	// it to the default callbacks output while the lock is held, i.e. to AfterLock and BeforeUnlock lines. It also makes a re-entrant Lock report
+	// ReentrantLockError as misuse instead of deadlocking silently.
+	// Getting the ID is slow, so use it for debugging only.
+	TrackGoroutineID bool
+	// Spin is the number of attempts to lock the mutex without blocking, yielding the processor between them,
+	// before falling back to a blocking lock. It may help for very short critical sections under moderate
+	// contention, but wastes CPU when the lock is held for long, so enable it only for measured short holds.
+	Spin int
+	// CollectStats enables collecting lock acquisition statistics returned by Stats
+	CollectStats bool
+	// CountPaths enables counting only acquisitions in Stats, Acquired, FastPathCount and SlowPathCount,
+	// without measuring time. They are counted with CollectStats as well
+	CountPaths bool
+	// TrackWaiters enables tracking wait start times of goroutines blocked on the write lock
+	// for LongestWaitDuration
+	TrackWaiters bool
+	// WaitTimeout is the threshold of waiting for the write lock after which OnWaitTimeout is called.
+	// It enables TrackWaiters
+	WaitTimeout time.Duration
+	// PanicOnMisuse makes Unlock and RUnlock of the mutex which is not locked panic with UnlockPanic
+	// after calling AfterUnlockRecover or AfterRUnlockRecover instead of only reporting it to them
+	PanicOnMisuse bool
+}
+
+// MutexStats are accumulated statistics of a mutex write lock acquisitions
+type MutexStats struct {
+	// Acquired is the number of lock acquisitions
+	Acquired uint64
+	// FastPathCount is the number of acquisitions which got the lock immediately
+	FastPathCount uint64
+	// SlowPathCount is the number of acquisitions which had to spin or wait for the lock
+	SlowPathCount uint64
+	// Contended is the number of acquisitions which had to wait for the lock.
+	//
+	// Deprecated: it equals SlowPathCount, use SlowPathCount instead.
+	Contended uint64
+	// WaitTime is the total time spent waiting for the lock
+	WaitTime time.Duration
+	// HoldTime is the total time the lock was held
+	HoldTime time.Duration
+}
+
+// watchInterval returns the shortest of timeout and p.HardTimeout set, or 0 if none of them was set
+func (p MutexParams) watchInterval(timeout time.Duration) time.Duration {
+	interval := timeout
+	if p.HardTimeout > 0 && (interval == 0 || p.HardTimeout < interval) {
+		interval = p.HardTimeout
+	}
+	return interval
+}
+
+// watch starts a watchdog reporting a lock hold of the given kind exceeding timeout or p.HardTimeout.
+// It should be called with callbacksMu locked. Returns a function stopping the watchdog.
+func (m *Mutex) watch(mname, kind string, timeout time.Duration, p MutexParams) (stop func()) {
+	watchInterval := p.watchInterval(timeout)
+	if watchInterval <= 0 {
+		return func() {}
+	}
+	onTimeout, onHardTimeout := m.OnTimeout, m.OnHardTimeout
+	lockedAt := time.Now()
+	ticker := time.NewTicker(watchInterval / 2)
+	closeC := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		hardTimeoutFired := false
+		for {
+			select {
+			case <-ticker.C:
+				select {
+				case <-closeC:
+					return
+				default:
+				}
+				var tag string
+				var tagInfo string
+				var holder uint64
+				var stack []byte
+				func() {
+					m.lockTagMu.Lock()
+					defer m.lockTagMu.Unlock()
+					if kind != "Lock" {
+						return
+					}
+					if m.lockTag != nil {
+						tag = *m.lockTag
+						tagInfo = fmt.Sprintf(" (tag=%q)", tag)
+					}
+					if m.holder != 0 {
+						holder = m.holder
+						tagInfo += fmt.Sprintf(" (goroutine=%d)", holder)
+					}
+					stack = m.lockStack
+				}()
+
+				duration := time.Now().Sub(lockedAt)
+				if timeout > 0 && duration >= timeout {
+					log.Printf("%s %s%s is locked by %s for %s", mname, p.Name, tagInfo, kind, duration)
+					e := TimeoutEvent{Name: p.Name, Tag: tag, Kind: kind, Held: duration, GoroutineID: holder}
+					if onTimeout != nil {
+						onTimeout(e)
+					}
+					e.Stack = stack
+					m.sendTimeoutEvent(e)
+					m.traceAs(fmt.Sprintf("%sTimeout held=%s", kind, duration), tagPtr(tag), holder)
+				}
+				if p.HardTimeout > 0 && duration >= p.HardTimeout && !hardTimeoutFired {
+					hardTimeoutFired = true
+					log.Printf("%s %s%s locked by %s exceeded hard timeout %s", mname, p.Name, tagInfo, kind, p.HardTimeout)
+					if p.DumpGoroutines {
+						printGoroutines(allStacks())
+					}
+					if onHardTimeout != nil {
+						onHardTimeout()
+					}
+				}
+			case <-closeC:
+				return
+			}
+		}
+	}()
+	return func() { close(closeC) }
 }
 
 // NewMutex returns a pointer to a new Mutex with default callbacks assigned
 func NewMutex(p MutexParams) *Mutex {
 	const mname = "Mutex"
-	m := &Mutex{}
-	haveWarningTimeout := p.Timeout > 0
-	if haveWarningTimeout {
-		m.ticker = time.NewTicker(p.Timeout)
-		m.closeC = make(chan struct{})
+	m := &Mutex{
+		name:             p.Name,
+		collectStats:     p.CollectStats,
+		countPaths:       p.CountPaths || p.CollectStats,
+		panicOnMisuse:    p.PanicOnMisuse,
+		trackGoroutineID: p.TrackGoroutineID,
+		spin:             p.Spin,
+		trackWaiters:     p.TrackWaiters || p.WaitTimeout > 0,
+		waitTimeout:      p.WaitTimeout,
 	}
 	if p.SetDefaultCallbacks {
+		haveWarningTimeout := p.watchInterval(p.Timeout) > 0
 		m.BeforeLock = func() { m.defaultCallback("BeforeLock", mname, p) }
 		m.AfterLock = func() {
 			m.defaultCallback("AfterLock", mname, p)
 			if haveWarningTimeout {
-				m.closeC = make(chan struct{})
-				func() {
-					m.lockedAtMu.Lock()
-					defer m.lockedAtMu.Unlock()
-					m.lockedAt = time.Now()
-				}()
-				go func() {
-					for {
-						select {
-						case <-m.ticker.C:
-							var tagInfo string
-							func() {
-								m.lockTagMu.Lock()
-								defer m.lockTagMu.Unlock()
-								if m.lockTag != nil {
-									tagInfo = fmt.Sprintf(" (tag=%q)", *m.lockTag)
-								}
-							}()
-							var lockedAtValue time.Time
-							func() {
-								m.lockedAtMu.Lock()
-								defer m.lockedAtMu.Unlock()
-								lockedAtValue = m.lockedAt
-							}()
-
-							if !lockedAtValue.IsZero() {
-								if duration := time.Now().Sub(lockedAtValue); duration >= p.Timeout {
-									log.Printf("%s %s%s is locked for %s", mname, p.Name, tagInfo, duration)
-								}
-							}
-						case <-m.closeC:
-							return
-						}
-					}
-				}()
-				m.ticker.Reset(p.Timeout / 2)
+				m.stopWatch = m.watch(mname, "Lock", p.Timeout, p)
 			}
 		}
 		m.BeforeUnlock = func() {
-			if haveWarningTimeout {
-				m.ticker.Stop()
-				func() {
-					m.lockedAtMu.Lock()
-					defer m.lockedAtMu.Unlock()
-					m.lockedAt = time.Time{}
-				}()
-				m.closeC <- struct{}{}
-			}
+			m.stopWatching()
 			m.defaultCallback("BeforeUnlock", mname, p)
 		}
 		m.AfterUnlock = func() { m.defaultCallback("AfterUnlock", mname, p) }
@@ -139,79 +416,608 @@ func NewMutex(p MutexParams) *Mutex {
 	return m
 }
 
+// TraceTo makes the mutex write a line per lock, unlock and timeout event with the time, name, tag
+// and goroutine ID to w, independently of the callbacks. Nil w disables tracing.
+// Getting the goroutine ID is slow, so use it for debugging only.
+func (m *Mutex) TraceTo(w io.Writer) {
+	m.traceMu.Lock()
+	defer m.traceMu.Unlock()
+	m.traceW = w
+	var tracing int32
+	if w != nil {
+		tracing = 1
+	}
+	atomic.StoreInt32(&m.tracing, tracing)
+}
+
+// trace writes the event of the calling goroutine to the trace writer if it was set, see TraceTo
+func (m *Mutex) trace(event string, tag *string) {
+	if atomic.LoadInt32(&m.tracing) != 0 {
+		m.traceAs(event, tag, goroutineID())
+	}
+}
+
+// traceAs writes the event of the goroutine gid to the trace writer if it was set, see TraceTo
+func (m *Mutex) traceAs(event string, tag *string, gid uint64) {
+	if atomic.LoadInt32(&m.tracing) == 0 {
+		return
+	}
+	m.traceMu.Lock()
+	defer m.traceMu.Unlock()
+	if m.traceW == nil {
+		return
+	}
+	tagInfo := ""
+	if tag != nil {
+		tagInfo = fmt.Sprintf(" (tag=%q)", *tag)
+	}
+	_, _ = fmt.Fprintf(m.traceW, "%s %s %s%s (goroutine=%d)\n",
+		time.Now().Format(time.RFC3339Nano), m.name, event, tagInfo, gid)
+}
+
+// tagPtr returns a pointer to tag, or nil if it is empty
+func tagPtr(tag string) *string {
+	if tag == "" {
+		return nil
+	}
+	return &tag
+}
+
+// stopWatching stops the timeout watchdog of the write lock hold if it was started. It must be called under callbacksMu
+func (m *Mutex) stopWatching() {
+	if m.stopWatch == nil {
+		return
+	}
+	m.stopWatch()
+	m.stopWatch = nil
+}
+
+// SetCallbacksEnabled enables or disables calling BeforeLock, AfterLock, BeforeUnlock, AfterUnlock
+// and AfterUnlockRecover callbacks, including the default ones and the timeout watchdog started by them.
+// Disabling stops the watchdog of the current lock hold. Callbacks are enabled initially.
+func (m *Mutex) SetCallbacksEnabled(enabled bool) {
+	m.callbacksMu.Lock()
+	defer m.callbacksMu.Unlock()
+	var disabled int32
+	if !enabled {
+		disabled = 1
+		m.stopWatching()
+	}
+	atomic.StoreInt32(&m.callbacksDisabled, disabled)
+}
+
+// callback calls fn under callbacksMu if it is set and callbacks are enabled.
+// Neither is checked under callbacksMu first, so the lock path without callbacks doesn't lock it
+func (m *Mutex) callback(fn *func()) {
+	if *fn == nil || m.callbacksOff() {
+		return
+	}
+	m.callbacksMu.Lock()
+	defer m.callbacksMu.Unlock()
+	if !m.callbacksOff() {
+		(*fn)()
+	}
+}
+
+// callbacksOff returns whether callbacks are disabled, see SetCallbacksEnabled
+func (m *Mutex) callbacksOff() bool { return atomic.LoadInt32(&m.callbacksDisabled) != 0 }
+
 func (m *Mutex) lock(tag *string) {
+	m.checkReentrant()
+	m.callback(&m.BeforeLock)
+	m.acquire()
+	m.locked(tag)
+}
+
+// checkReentrant reports ReentrantLockError as misuse if the calling goroutine already holds the write lock,
+// which would deadlock otherwise. It requires MutexParams.TrackGoroutineID.
+func (m *Mutex) checkReentrant() {
+	if !m.trackGoroutineID {
+		return
+	}
+	gid := goroutineID()
+	var holderStack []byte
+	reentrant := func() bool {
+		m.lockTagMu.Lock()
+		defer m.lockTagMu.Unlock()
+		holderStack = m.lockStack
+		return !m.lockedAt.IsZero() && m.holder == gid
+	}()
+	if reentrant {
+		m.misuse(ReentrantLockError{Name: m.name, GoroutineID: gid, HolderStack: holderStack, Stack: debug.Stack()})
+	}
+}
+
+// locked records the lock holder state and calls AfterLock callback after the underlying mutex was locked
+func (m *Mutex) locked(tag *string) {
+	var holder uint64
+	var stack []byte
+	if m.trackGoroutineID {
+		holder = goroutineID()
+	}
+	if m.trackGoroutineID || m.haveTimeoutEvents() {
+		stack = debug.Stack()
+	}
+	lockedAt := time.Now()
 	func() {
-		m.callbacksMu.Lock()
-		defer m.callbacksMu.Unlock()
-		if m.BeforeLock != nil {
-			m.BeforeLock()
+		m.lockTagMu.Lock()
+		defer m.lockTagMu.Unlock()
+		if tag != nil {
+			m.lockTag = tag
 		}
+		m.lockedAt = lockedAt
+		m.writeGen++
+		m.holder, m.lockStack = holder, stack
 	}()
+	m.callback(&m.AfterLock)
+	m.trace("Lock", tag)
+}
 
-	m.mu.Lock()
+// Waiters returns the number of goroutines currently blocked waiting for the lock
+func (m *Mutex) Waiters() int { return int(atomic.LoadInt32(&m.waiters)) }
 
-	func() {
-		m.callbacksMu.Lock()
-		defer m.callbacksMu.Unlock()
-		func() {
-			m.lockTagMu.Lock()
-			defer m.lockTagMu.Unlock()
-			if tag != nil {
-				m.lockTag = tag
-			}
-		}()
-		if m.AfterLock != nil {
-			m.AfterLock()
+// spinLock tries to lock the underlying mutex up to m.spin times yielding the processor between attempts.
+// Returns whether it was locked
+func (m *Mutex) spinLock() bool {
+	for i := 0; i < m.spin; i++ {
+		runtime.Gosched()
+		if m.mu.TryLock() {
+			return true
 		}
-	}()
+	}
+	return false
 }
 
-// Lock calls the underlying Mutex.Lock method. BeforeLock and AfterLock callbacks will be executed
-// before and after such call respectively. If callback was not specified, it will be ignored.
-func (m *Mutex) Lock() { m.lock(nil) }
+// acquire locks the underlying mutex, spinning before blocking if enabled and collecting stats if enabled
+func (m *Mutex) acquire() {
+	atomic.AddInt32(&m.waiters, 1)
+	defer atomic.AddInt32(&m.waiters, -1)
+	if !m.countPaths && m.spin == 0 && !m.trackWaiters {
+		m.mu.Lock()
+		return
+	}
 
-// LockWithTag works like Lock but adds a specified tag to help in debugging process
-func (m *Mutex) LockWithTag(tag string) { m.lock(&tag) }
+	var start time.Time
+	if m.collectStats || m.trackWaiters {
+		start = time.Now()
+	}
+	contended := !m.mu.TryLock()
+	if contended {
+		m.lockContended(start)
+	}
+	m.recordAcquired(start, contended)
+}
 
-// Unlock calls the underlying Mutex.Unlock method. BeforeUnlock and AfterUnlock callbacks will be executed
-// before and after such call respectively. If a panic will occur at underlying Mutex unlocking, it will be
-// handled by a call to recover() and BeforeUnlockRecover and AfterUnlockRecover will be called respectively.
-// If callback was not specified, it will be ignored.
-func (m *Mutex) Unlock() {
+// lockContended locks the underlying mutex after a failed attempt started at start,
+// spinning before blocking if enabled
+func (m *Mutex) lockContended(start time.Time) {
+	if !m.spinLock() {
+		stopWait := m.waitStarted(start)
+		m.mu.Lock()
+		stopWait()
+	}
+}
+
+// waitStarted registers a waiter blocked on the write lock since start if waiters are tracked
+// and schedules OnWaitTimeout call. Returns a function unregistering the waiter
+func (m *Mutex) waitStarted(start time.Time) (stop func()) {
+	if !m.trackWaiters {
+		return func() {}
+	}
+	var id uint64
 	func() {
-		m.callbacksMu.Lock()
-		defer m.callbacksMu.Unlock()
-		if m.BeforeUnlock != nil {
-			m.BeforeUnlock()
+		m.waitersMu.Lock()
+		defer m.waitersMu.Unlock()
+		if m.waitStarts == nil {
+			m.waitStarts = make(map[uint64]time.Time)
 		}
+		m.lastWaiterID++
+		id = m.lastWaiterID
+		m.waitStarts[id] = start
 	}()
 
+	var timer *time.Timer
+	if m.waitTimeout > 0 {
+		timer = time.AfterFunc(m.waitTimeout-time.Now().Sub(start), func() {
+			m.callbacksMu.Lock()
+			onWaitTimeout := m.OnWaitTimeout
+			m.callbacksMu.Unlock()
+			if onWaitTimeout != nil {
+				onWaitTimeout(time.Now().Sub(start))
+			}
+		})
+	}
+	return func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		m.waitersMu.Lock()
+		defer m.waitersMu.Unlock()
+		delete(m.waitStarts, id)
+	}
+}
+
+// LongestWaitDuration returns how long the longest waiting goroutine currently blocked on the write lock
+// has been waiting, 0 if there are no such goroutines. It requires MutexParams.TrackWaiters.
+func (m *Mutex) LongestWaitDuration() time.Duration {
+	m.waitersMu.Lock()
+	defer m.waitersMu.Unlock()
+	var longest time.Duration
+	now := time.Now()
+	for _, start := range m.waitStarts {
+		if waited := now.Sub(start); waited > longest {
+			longest = waited
+		}
+	}
+	return longest
+}
+
+// recordAcquired records lock acquisition stats for the lock attempt started at start if they are collected.
+// The acquisition went the slow path if it was contended
+func (m *Mutex) recordAcquired(start time.Time, contended bool) {
+	if !m.countPaths {
+		return
+	}
+	var acquiredAt time.Time
+	if m.collectStats {
+		acquiredAt = time.Now()
+	}
+	m.statsMu.Lock()
+	defer m.statsMu.Unlock()
+	m.stats.Acquired++
+	if contended {
+		m.stats.SlowPathCount++
+		m.stats.Contended++
+	} else {
+		m.stats.FastPathCount++
+	}
+	if m.collectStats {
+		m.stats.WaitTime += acquiredAt.Sub(start)
+		m.acquiredAt = acquiredAt
+	}
+}
+
+// tryLock locks the mutex only if it is not locked. Returns whether it was locked
+func (m *Mutex) tryLock(tag *string) bool {
+	start := time.Now()
+	if !m.mu.TryLock() {
+		return false
+	}
+	m.recordAcquired(start, false)
+	m.locked(tag)
+	return true
+}
+
+// lockContext locks the mutex or returns ctx.Err() if ctx is done before the mutex was locked
+func (m *Mutex) lockContext(ctx context.Context, tag *string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.checkReentrant()
+	m.callback(&m.BeforeLock)
+	if !m.acquireContext(ctx) {
+		return ctx.Err()
+	}
+	m.locked(tag)
+	return nil
+}
+
+// acquireContext locks the underlying mutex like acquire, or returns false if ctx is done before
+// the mutex was locked. The underlying mutex of an abandoned attempt is unlocked as soon as it is locked
+func (m *Mutex) acquireContext(ctx context.Context) bool {
+	start := time.Now()
+	if m.mu.TryLock() {
+		m.recordAcquired(start, false)
+		return true
+	}
+
+	// the caller is the waiter, so it is unregistered as soon as the caller stops waiting,
+	// even if the helper goroutine of an abandoned attempt still waits for the mutex
+	atomic.AddInt32(&m.waiters, 1)
+	stopWait := m.waitStarted(start)
 	defer func() {
-		r := recover()
-		if r == nil {
-			return
+		stopWait()
+		atomic.AddInt32(&m.waiters, -1)
+	}()
+	acquiredC := make(chan struct{})
+	go func() {
+		if !m.spinLock() {
+			m.mu.Lock()
+		}
+		close(acquiredC)
+	}()
+	select {
+	case <-acquiredC:
+	case <-ctx.Done():
+		select {
+		case <-acquiredC:
+		default:
+			// the underlying mutex can't be cancelled, so unlock it as soon as the abandoned attempt locks it,
+			// the abandoned acquisition is not recorded in the stats
+			go func() {
+				<-acquiredC
+				m.mu.Unlock()
+			}()
+			return false
 		}
+	}
+	m.recordAcquired(start, true)
+	return true
+}
+
+// LockContext locks the mutex like Lock, or returns ctx.Err() if ctx is done before the mutex was locked.
+// AfterLock callback is called only if the mutex was locked. The underlying mutex can't be cancelled,
+// so a contended attempt runs in a helper goroutine, and the goroutine of a cancelled attempt still
+// waits for the mutex and unlocks it immediately, delaying other waiters a bit.
+func (m *Mutex) LockContext(ctx context.Context) error { return m.lockContext(ctx, nil) }
+
+// LockOrContext is an alias of LockContext.
+//
+// Deprecated: use LockContext instead.
+func (m *Mutex) LockOrContext(ctx context.Context) error { return m.lockContext(ctx, nil) }
+
+// LockContextWithTag works like LockContext but adds a specified tag to help in debugging process
+func (m *Mutex) LockContextWithTag(ctx context.Context, tag string) error {
+	return m.lockContext(ctx, &tag)
+}
+
+// TryLock locks the mutex only if it is not locked and returns whether it was locked.
+// BeforeLock callback is not called, AfterLock callback is called only if the mutex was locked.
+func (m *Mutex) TryLock() bool { return m.tryLock(nil) }
+
+// TryLockTimeout locks the mutex if it gets locked within d and returns whether it was locked.
+// Like TryLock, BeforeLock callback is not called, AfterLock callback is called only if the mutex was locked,
+// and no mutex state is changed otherwise. A contended attempt runs in a helper goroutine as for LockContext.
+func (m *Mutex) TryLockTimeout(d time.Duration) bool {
+	if m.TryLock() {
+		return true
+	}
+	if d <= 0 {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	if !m.acquireContext(ctx) {
+		return false
+	}
+	m.locked(nil)
+	return true
+}
+
+// TryLockWithTag works like TryLock but adds a specified tag to help in debugging process
+func (m *Mutex) TryLockWithTag(tag string) bool { return m.tryLock(&tag) }
+
+// LockIfUnlocked is an alias of TryLock for opportunistic work which should be skipped if the mutex is locked
+func (m *Mutex) LockIfUnlocked() bool { return m.TryLock() }
+
+// DoIfUnlocked runs fn under the lock only if the mutex could be locked without blocking.
+// The mutex is unlocked even if fn panics. Returns whether fn was run
+func (m *Mutex) DoIfUnlocked(fn func()) bool {
+	if !m.TryLock() {
+		return false
+	}
+	defer m.Unlock()
+	fn()
+	return true
+}
+
+// release unlocks the underlying mutex, collecting stats if enabled
+func (m *Mutex) release() {
+	if m.collectStats {
+		func() {
+			m.statsMu.Lock()
+			defer m.statsMu.Unlock()
+			if !m.acquiredAt.IsZero() {
+				m.stats.HoldTime += time.Now().Sub(m.acquiredAt)
+				m.acquiredAt = time.Time{}
+			}
+		}()
+	}
+	m.mu.Unlock()
+}
+
+// Stats returns the accumulated lock statistics. It requires MutexParams.CollectStats,
+// or MutexParams.CountPaths for the acquisition counts only.
+func (m *Mutex) Stats() MutexStats {
+	m.statsMu.Lock()
+	defer m.statsMu.Unlock()
+	return m.stats
+}
+
+// ResetStats zeroes the accumulated lock statistics and returns their values before the reset
+func (m *Mutex) ResetStats() MutexStats {
+	m.statsMu.Lock()
+	defer m.statsMu.Unlock()
+	stats := m.stats
+	m.stats = MutexStats{}
+	return stats
+}
+
+// unlockMisused calls recovered callback with p, then panics with p if MutexParams.PanicOnMisuse was set
+func (m *Mutex) unlockMisused(p UnlockPanic, recovered *func(r interface{})) {
+	if *recovered != nil && !m.callbacksOff() {
 		func() {
 			m.callbacksMu.Lock()
 			defer m.callbacksMu.Unlock()
-			if m.AfterUnlockRecover != nil {
-				m.AfterUnlockRecover(r)
+			if !m.callbacksOff() {
+				(*recovered)(p)
 			}
 		}()
+	}
+	if m.panicOnMisuse {
+		panic(p)
+	}
+}
+
+// misuse reports a violated lock expectation by calling OnMisuse, or panics with err if it was not specified
+func (m *Mutex) misuse(err error) {
+	m.callbacksMu.Lock()
+	onMisuse := m.OnMisuse
+	m.callbacksMu.Unlock()
+	if onMisuse == nil {
+		panic(err)
+	}
+	onMisuse(err)
+}
+
+// IsLocked returns whether the write lock is held
+func (m *Mutex) IsLocked() bool {
+	m.lockTagMu.Lock()
+	defer m.lockTagMu.Unlock()
+	return !m.lockedAt.IsZero()
+}
+
+// HeldFor returns how long the write lock is held, 0 if it is not held
+func (m *Mutex) HeldFor() time.Duration {
+	m.lockTagMu.Lock()
+	defer m.lockTagMu.Unlock()
+	if m.lockedAt.IsZero() {
+		return 0
+	}
+	return time.Now().Sub(m.lockedAt)
+}
+
+// CurrentTag returns the tag the write lock is held with, and false if it is held without a tag or not held
+func (m *Mutex) CurrentTag() (string, bool) {
+	m.lockTagMu.Lock()
+	defer m.lockTagMu.Unlock()
+	if m.lockTag == nil {
+		return "", false
+	}
+	return *m.lockTag, true
+}
+
+// writeGeneration returns the number of the write lock acquisitions
+func (m *Mutex) writeGeneration() uint64 {
+	m.lockTagMu.Lock()
+	defer m.lockTagMu.Unlock()
+	return m.writeGen
+}
+
+// heldByCaller returns whether the write lock is held, and if MutexParams.TrackGoroutineID was set,
+// whether it is held by the calling goroutine
+func (m *Mutex) heldByCaller() bool {
+	m.lockTagMu.Lock()
+	defer m.lockTagMu.Unlock()
+	if m.lockedAt.IsZero() {
+		return false
+	}
+	return !m.trackGoroutineID || m.holder == goroutineID()
+}
+
+// AssertHeld panics with ErrMutexNotHeld, or calls OnMisuse with it, if the write lock is not held.
+// If MutexParams.TrackGoroutineID was set, the lock must be held by the calling goroutine.
+func (m *Mutex) AssertHeld() {
+	if !m.heldByCaller() {
+		m.misuse(ErrMutexNotHeld)
+	}
+}
+
+// AssertNotHeld panics with ErrMutexHeld, or calls OnMisuse with it, if the write lock is held.
+// If MutexParams.TrackGoroutineID was set, only the lock held by the calling goroutine is a violation.
+func (m *Mutex) AssertNotHeld() {
+	if m.heldByCaller() {
+		m.misuse(ErrMutexHeld)
+	}
+}
+
+// CriticalSection locks the mutex, calls fn and unlocks the mutex even if fn panics.
+// The duration of fn is added to the total hold time of the sections named by name, see SectionStats.
+func (m *Mutex) CriticalSection(name string, fn func()) {
+	m.LockWithTag(name)
+	defer m.Unlock()
+	start := time.Now()
+	defer func() {
+		duration := time.Now().Sub(start)
+		m.statsMu.Lock()
+		defer m.statsMu.Unlock()
+		if m.sections == nil {
+			m.sections = make(map[string]time.Duration)
+		}
+		m.sections[name] += duration
 	}()
-	func() {
+	fn()
+}
 
+// SectionStats returns the total hold time of the critical sections by their names, see CriticalSection
+func (m *Mutex) SectionStats() map[string]time.Duration {
+	m.statsMu.Lock()
+	defer m.statsMu.Unlock()
+	stats := make(map[string]time.Duration, len(m.sections))
+	for name, d := range m.sections {
+		stats[name] = d
+	}
+	return stats
+}
+
+// lockOrder returns ms without duplicates and nils sorted by their addresses
+func lockOrder(ms []*Mutex) []*Mutex {
+	ordered := make([]*Mutex, 0, len(ms))
+	seen := make(map[*Mutex]bool, len(ms))
+	for _, m := range ms {
+		if m != nil && !seen[m] {
+			seen[m] = true
+			ordered = append(ordered, m)
+		}
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		return uintptr(unsafe.Pointer(ordered[i])) < uintptr(unsafe.Pointer(ordered[j]))
+	})
+	return ordered
+}
+
+// LockAll locks all ms in the order of their addresses, so goroutines locking intersecting sets
+// of mutexes with LockAll don't deadlock. Each mutex is locked once even if passed several times.
+// Callbacks of each mutex are called as by Lock.
+func LockAll(ms ...*Mutex) {
+	for _, m := range lockOrder(ms) {
+		m.Lock()
+	}
+}
+
+// UnlockAll unlocks all ms locked by LockAll in the reverse order
+func UnlockAll(ms ...*Mutex) {
+	ordered := lockOrder(ms)
+	for i := len(ordered) - 1; i >= 0; i-- {
+		ordered[i].Unlock()
+	}
+}
+
+// Lock calls the underlying Mutex.Lock method. BeforeLock and AfterLock callbacks will be executed
+// before and after such call respectively. If callback was not specified, it will be ignored.
+func (m *Mutex) Lock() { m.lock(nil) }
+
+// LockWithTag works like Lock but adds a specified tag to help in debugging process
+func (m *Mutex) LockWithTag(tag string) { m.lock(&tag) }
+
+// Unlock calls the underlying Mutex.Unlock method. BeforeUnlock and AfterUnlock callbacks will be executed
+// before and after such call respectively. Unlocking of the mutex which is not locked is detected before
+// the underlying unlock, which would be a fatal error otherwise: AfterUnlockRecover is called with UnlockPanic
+// instead, and it is panicked with if MutexParams.PanicOnMisuse was set. If callback was not specified,
+// it will be ignored.
+func (m *Mutex) Unlock() {
+	m.callback(&m.BeforeUnlock)
+
+	var tag *string
+	wasLocked := func() bool {
 		m.lockTagMu.Lock()
 		defer m.lockTagMu.Unlock()
-		m.lockTag = nil
-	}()
-	m.mu.Unlock()
-
-	func() {
-		m.callbacksMu.Lock()
-		defer m.callbacksMu.Unlock()
-		if m.AfterUnlock != nil {
-			m.AfterUnlock()
+		if m.lockedAt.IsZero() {
+			tag = m.lastTag
+			return false
 		}
+		tag = m.lockTag
+		m.lastTag, m.lockTag = tag, nil
+		m.lockedAt = time.Time{}
+		m.holder = 0
+		m.lockStack = nil
+		return true
 	}()
+	if !wasLocked {
+		m.unlockMisused(UnlockPanic{Name: m.name, Tag: tag, Value: errUnlockOfUnlocked}, &m.AfterUnlockRecover)
+		return
+	}
+	m.release()
+	m.trace("Unlock", tag)
+	m.callback(&m.AfterUnlock)
 }
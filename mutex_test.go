@@ -0,0 +1,271 @@
+package synced
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMutexUnlockOfUnlocked(t *testing.T) {
+	m := NewMutex(MutexParams{Name: "m"})
+	var recovered interface{}
+	m.AfterUnlockRecover = func(r interface{}) { recovered = r }
+	m.LockWithTag("t")
+	m.Unlock()
+	m.Unlock()
+	p, ok := recovered.(UnlockPanic)
+	if !ok || p.Name != "m" || p.Tag == nil || *p.Tag != "t" {
+		t.Fatalf("AfterUnlockRecover got %v, want UnlockPanic of m with tag t", recovered)
+	}
+	m.Lock()
+	m.Unlock()
+}
+
+func TestMutexPanicOnMisuse(t *testing.T) {
+	for _, panicOnMisuse := range []bool{false, true} {
+		m := NewMutex(MutexParams{Name: "m", PanicOnMisuse: panicOnMisuse})
+		var recovered interface{}
+		m.AfterUnlockRecover = func(r interface{}) { recovered = r }
+		panicked := func() (panicked bool) {
+			defer func() { panicked = recover() != nil }()
+			m.Unlock()
+			return false
+		}()
+		if panicked != panicOnMisuse {
+			t.Fatalf("PanicOnMisuse=%v: Unlock panicked = %v", panicOnMisuse, panicked)
+		}
+		if _, ok := recovered.(UnlockPanic); !ok {
+			t.Fatalf("PanicOnMisuse=%v: AfterUnlockRecover got %v, want UnlockPanic", panicOnMisuse, recovered)
+		}
+	}
+}
+
+func TestRWMutexPanicOnMisuse(t *testing.T) {
+	for _, panicOnMisuse := range []bool{false, true} {
+		m := NewRWMutex(MutexParams{Name: "m", PanicOnMisuse: panicOnMisuse})
+		var recovered interface{}
+		m.AfterRUnlockRecover = func(r interface{}) { recovered = r }
+		m.RLock()
+		m.RUnlock()
+		panicked := func() (panicked bool) {
+			defer func() { panicked = recover() != nil }()
+			m.RUnlock()
+			return false
+		}()
+		if panicked != panicOnMisuse {
+			t.Fatalf("PanicOnMisuse=%v: RUnlock panicked = %v", panicOnMisuse, panicked)
+		}
+		if _, ok := recovered.(UnlockPanic); !ok {
+			t.Fatalf("PanicOnMisuse=%v: AfterRUnlockRecover got %v, want UnlockPanic", panicOnMisuse, recovered)
+		}
+		m.Lock()
+		m.Unlock()
+	}
+}
+
+func TestMutexLockContextContendedIsSlowPath(t *testing.T) {
+	m := NewMutex(MutexParams{CountPaths: true})
+	m.Lock()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		m.Unlock()
+	}()
+	if err := m.LockContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	m.Unlock()
+	stats := m.Stats()
+	if stats.Acquired != 2 || stats.FastPathCount != 1 || stats.SlowPathCount != 1 || stats.Contended != 1 {
+		t.Fatalf("stats %+v, want 2 acquisitions, 1 of them contended", stats)
+	}
+}
+
+func TestMutexTryLockTimeoutWhenHeld(t *testing.T) {
+	m := NewMutex(MutexParams{CollectStats: true})
+	m.LockWithTag("holder")
+	if m.TryLockTimeout(10 * time.Millisecond) {
+		t.Fatal("TryLockTimeout locked the held mutex")
+	}
+	if tag, ok := m.CurrentTag(); !ok || tag != "holder" {
+		t.Fatalf("CurrentTag returned %q, %v, want holder", tag, ok)
+	}
+	m.Unlock()
+
+	// the abandoned attempt locks and unlocks the underlying mutex after the holder
+	if !m.TryLockTimeout(time.Second) {
+		t.Fatal("TryLockTimeout failed on the released mutex")
+	}
+	m.Unlock()
+	if m.IsLocked() {
+		t.Fatal("mutex is left locked")
+	}
+	if stats := m.Stats(); stats.Acquired != 2 {
+		t.Fatalf("stats %+v, want 2 acquisitions", stats)
+	}
+}
+
+func TestMutexTryLockTimeoutUnregistersWaiter(t *testing.T) {
+	m := NewMutex(MutexParams{WaitTimeout: 20 * time.Millisecond})
+	waitTimeouts := int32(0)
+	m.OnWaitTimeout = func(time.Duration) { atomic.AddInt32(&waitTimeouts, 1) }
+	m.Lock()
+	if m.TryLockTimeout(5 * time.Millisecond) {
+		t.Fatal("TryLockTimeout locked the held mutex")
+	}
+	if n, d := m.Waiters(), m.LongestWaitDuration(); n != 0 || d != 0 {
+		t.Fatalf("Waiters %d, LongestWaitDuration %s after the failed attempt, want none", n, d)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if n := atomic.LoadInt32(&waitTimeouts); n != 0 {
+		t.Fatalf("OnWaitTimeout called %d times for the failed attempt", n)
+	}
+	m.Unlock()
+}
+
+func TestMutexLockContextCancelledWhileReleased(t *testing.T) {
+	m := NewMutex(MutexParams{})
+	for i := 0; i < 200; i++ {
+		m.Lock()
+		ctx, cancel := context.WithCancel(context.Background())
+		startC := make(chan struct{})
+		go func() {
+			<-startC
+			m.Unlock()
+		}()
+		go func() {
+			<-startC
+			cancel()
+		}()
+		close(startC)
+		if err := m.LockContext(ctx); err == nil {
+			m.Unlock()
+		}
+		cancel()
+		if !m.TryLockTimeout(time.Second) {
+			t.Fatalf("iteration %d: mutex is left held", i)
+		}
+		m.Unlock()
+	}
+	if m.IsLocked() {
+		t.Fatal("mutex is left locked")
+	}
+}
+
+func TestMutexSetCallbacksEnabled(t *testing.T) {
+	m := NewMutex(MutexParams{})
+	calls := 0
+	m.BeforeLock = func() { calls++ }
+	m.AfterUnlock = func() { calls++ }
+	m.SetCallbacksEnabled(false)
+	m.Lock()
+	if !m.IsLocked() {
+		t.Fatal("IsLocked returned false for the locked mutex")
+	}
+	m.Unlock()
+	if calls != 0 || m.IsLocked() {
+		t.Fatalf("callbacks called %d times while disabled, IsLocked %v", calls, m.IsLocked())
+	}
+	m.SetCallbacksEnabled(true)
+	m.Lock()
+	m.Unlock()
+	if calls != 2 {
+		t.Fatalf("callbacks called %d times, want 2", calls)
+	}
+}
+
+func TestMutexDefaultCallbacksGoroutineID(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	m := NewMutex(MutexParams{Name: "m", SetDefaultCallbacks: true, TrackGoroutineID: true})
+	m.Lock()
+	m.Unlock()
+	holder := fmt.Sprintf("(goroutine=%d)", goroutineID())
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		held := strings.Contains(line, "AfterLock") || strings.Contains(line, "BeforeUnlock")
+		if strings.Contains(line, holder) != held {
+			t.Fatalf("line %q, want holder %s only in AfterLock and BeforeUnlock lines", line, holder)
+		}
+	}
+}
+
+func TestMutexTimeoutEventsReopen(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	m := NewMutex(MutexParams{Name: "m", SetDefaultCallbacks: true, Timeout: 10 * time.Millisecond})
+	receive := func(events <-chan TimeoutEvent) {
+		t.Helper()
+		m.LockWithTag("slow")
+		defer m.Unlock()
+		select {
+		case e, ok := <-events:
+			if !ok || e.Tag != "slow" {
+				t.Fatalf("received %+v, %v, want event of the lock tagged slow", e, ok)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no timeout event received")
+		}
+	}
+	events := m.TimeoutEvents()
+	receive(events)
+	m.CloseTimeoutEvents()
+	for range events {
+	}
+	reopened := m.TimeoutEvents()
+	if reopened == events {
+		t.Fatal("TimeoutEvents returned the closed channel")
+	}
+	receive(reopened)
+	m.CloseTimeoutEvents()
+}
+
+func benchmarkMutex(b *testing.B, p MutexParams) {
+	m := NewMutex(p)
+	counter := 0
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			m.Lock()
+			counter++
+			m.Unlock()
+		}
+	})
+}
+
+func BenchmarkMutexLock(b *testing.B) { benchmarkMutex(b, MutexParams{}) }
+
+func BenchmarkMutexSpin(b *testing.B) { benchmarkMutex(b, MutexParams{Spin: 10}) }
+
+// BenchmarkMutexUncontended compares the plain and the callbacks disabled Lock and Unlock
+// with the raw sync.RWMutex they are built on
+func BenchmarkMutexUncontended(b *testing.B) {
+	b.Run("sync.RWMutex", func(b *testing.B) {
+		var m sync.RWMutex
+		for i := 0; i < b.N; i++ {
+			m.Lock()
+			m.Unlock()
+		}
+	})
+	b.Run("Mutex", func(b *testing.B) {
+		m := NewMutex(MutexParams{})
+		for i := 0; i < b.N; i++ {
+			m.Lock()
+			m.Unlock()
+		}
+	})
+	b.Run("CallbacksDisabled", func(b *testing.B) {
+		m := NewMutex(MutexParams{SetDefaultCallbacks: true, Timeout: time.Second})
+		m.SetCallbacksEnabled(false)
+		for i := 0; i < b.N; i++ {
+			m.Lock()
+			m.Unlock()
+		}
+	})
+}
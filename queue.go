@@ -1,15 +1,32 @@
 package synced
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"sync"
+	"time"
+	"unsafe"
 )
 
 // mode constants
 const (
 	modeNormal = iota
 	modeDrop   // drops elements if push overflows
+	modeBlock  // blocks push until there is room
+)
+
+// OverflowPolicy defines the behavior of a limited queue on push when it is full
+type OverflowPolicy int
+
+// overflow policies
+const (
+	OverflowReject OverflowPolicy = modeNormal // push returns ErrQueueOverflowed
+	OverflowDrop   OverflowPolicy = modeDrop   // push drops the earliest elements
+	OverflowBlock  OverflowPolicy = modeBlock  // push blocks until there is room
 )
 
 // various constants
@@ -24,6 +41,12 @@ var (
 	ErrQueueOverflowed = errors.New("queue overflowed")
 	ErrFailedToDrop    = func(err error) error { return fmt.Errorf("failed to drop element: %v", err) }
 	ErrOutOfBounds     = errors.New("index out of bounds")
+	ErrNoDeadLetter    = errors.New("no dead-letter queue")
+	ErrNoMatch         = errors.New("no matching element")
+	ErrKeyMismatch     = errors.New("key doesn't match the object key")
+	ErrFailedToRequeue = func(err, cause error) error {
+		return fmt.Errorf("failed to requeue elements after error %q: %v", cause, err)
+	}
 )
 
 // Queue that is thread-safe
@@ -31,7 +54,163 @@ type Queue struct {
 	queue  []interface{}
 	maxLen int
 	mode   int
-	sync.Mutex
+	lifo   bool       // pops the latest elements first, overflow still drops the earliest ones
+	mutex  sync.Mutex // the queue lock unless the queue is named, see Lock
+
+	initialMaxLen int // the limit an elastic queue starts with and shrinks to
+	ceilingMaxLen int // the limit an elastic queue grows up to, 0 if the queue is not elastic
+
+	maxBytes int
+	bytes    int
+	sizeOf   func(interface{}) int
+
+	keyFunc func(interface{}) string
+	keys    map[string]int // number of pending elements by key
+
+	mu           *Mutex
+	mutexParams  MutexParams
+	jsonEnvelope bool
+	cond         *sync.Cond
+
+	observer   QueueObserver
+	deadLetter *Queue
+	stats      QueueStats
+
+	visibilityTimeout time.Duration
+
+	ttl         time.Duration
+	pushedAt    []time.Time // push times of the elements if the queue has TTL
+	stopSweeper func()
+
+	samples        []DepthSample // ring of the queue length samples
+	samplesPos     int
+	stopSampler    func()
+	inFlight       map[uint64]interface{} // reserved elements by reservation ID, see ReservePop
+	lastInFlightID uint64
+
+	// OnDrop is called under the queue lock for each element dropped from the queue
+	OnDrop func(dropped interface{})
+	// OnOverflow is called under the queue lock with the element rejected because the queue is full.
+	// The lock is released if OnDrop or OnOverflow panics.
+	OnOverflow func(rejected interface{})
+	// OnEmpty is called under the queue lock when removing elements makes the queue empty
+	OnEmpty func()
+}
+
+// QueueObserver observes queue operations, e.g. to collect metrics. Each method is called
+// with the element and the resulting queue length. The methods are called under the queue lock,
+// so they should be fast and must not call the queue methods.
+type QueueObserver interface {
+	// OnPush is called when an element is pushed to the queue
+	OnPush(element interface{}, n int)
+	// OnPop is called when an element is popped from the queue
+	OnPop(element interface{}, n int)
+	// OnDrop is called when an element is dropped from the queue
+	OnDrop(element interface{}, n int)
+	// OnOverflow is called when an element is rejected because the queue is full
+	OnOverflow(element interface{}, n int)
+}
+
+// QueueStats are accumulated statistics of queue operations
+type QueueStats struct {
+	// Len is the current queue length
+	Len int `json:"len"`
+	// Pushed is the number of pushed elements, including the ones pushed back by Flush, nack and requeue,
+	// and restored by UnmarshalJSON
+	Pushed uint64 `json:"pushed"`
+	// Popped is the number of popped elements, including the ones taken by Flush, Merge, SwapContents,
+	// Range and UnmarshalJSON
+	Popped uint64 `json:"popped"`
+	// Dropped is the number of dropped elements
+	Dropped uint64 `json:"dropped"`
+}
+
+// QueueOption configures a queue created by NewQueueWithOptions or NewNamedQueue
+type QueueOption func(q *Queue)
+
+// QueueWithMaxLen limits the queue length by max
+func QueueWithMaxLen(max int) QueueOption { return func(q *Queue) { q.maxLen = max } }
+
+// QueueWithElasticMaxLen limits the queue length by initialMax, doubling the limit on overflow up to ceilingMax
+func QueueWithElasticMaxLen(initialMax, ceilingMax int) QueueOption {
+	return func(q *Queue) { q.maxLen, q.initialMaxLen, q.ceilingMaxLen = initialMax, initialMax, ceilingMax }
+}
+
+// QueueWithDropMode makes the limited queue drop the earliest elements on overflow
+func QueueWithDropMode() QueueOption { return func(q *Queue) { q.mode = modeDrop } }
+
+// QueueWithLIFO makes the queue a stack popping the latest elements first.
+// A dropping stack still drops the earliest elements on overflow
+func QueueWithLIFO() QueueOption { return func(q *Queue) { q.lifo = true } }
+
+// QueueWithOverflowPolicy sets the behavior of the limited queue on overflow
+func QueueWithOverflowPolicy(policy OverflowPolicy) QueueOption {
+	return func(q *Queue) { q.mode = int(policy) }
+}
+
+// QueueWithByteLimit limits the total size of queue elements by maxBytes. Element size is got by sizeOf
+func QueueWithByteLimit(maxBytes int, sizeOf func(interface{}) int) QueueOption {
+	return func(q *Queue) { q.maxBytes, q.sizeOf = maxBytes, sizeOf }
+}
+
+// QueueWithKeyFunc makes the queue coalesce pushed elements by key got by fn,
+// an element is not pushed if an element with the same key is already pending
+func QueueWithKeyFunc(fn func(interface{}) string) QueueOption {
+	return func(q *Queue) { q.keyFunc = fn }
+}
+
+// QueueWithObserver sets the observer of queue operations
+func QueueWithObserver(observer QueueObserver) QueueOption {
+	return func(q *Queue) { q.observer = observer }
+}
+
+// QueueWithDeadLetter sets the queue receiving elements which exceeded the retry limit,
+// see RequeueOrDeadLetter
+func QueueWithDeadLetter(dlq *Queue) QueueOption { return func(q *Queue) { q.deadLetter = dlq } }
+
+// QueueWithVisibilityTimeout makes elements reserved by ReservePop return to the queue
+// if they are not acknowledged within d
+func QueueWithVisibilityTimeout(d time.Duration) QueueOption {
+	return func(q *Queue) { q.visibilityTimeout = d }
+}
+
+// QueueWithMutexParams sets parameters of the underlying Mutex of a named queue.
+// The name is taken from NewNamedQueue.
+func QueueWithMutexParams(p MutexParams) QueueOption { return func(q *Queue) { q.mutexParams = p } }
+
+// QueueWithJSONEnvelope makes the queue marshal to JSON as an object holding its mode and limit
+// along with the elements, so they are restored on unmarshaling
+func QueueWithJSONEnvelope() QueueOption { return func(q *Queue) { q.jsonEnvelope = true } }
+
+// applyQueueOptions returns a prototype of a queue configured by opts
+func applyQueueOptions(opts []QueueOption) *Queue {
+	o := &Queue{mode: modeNormal}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// fromPrototype returns a new empty queue configured like o
+func (o *Queue) fromPrototype() Queue {
+	return Queue{
+		queue:             make([]interface{}, 0, o.maxLen),
+		maxLen:            o.maxLen,
+		initialMaxLen:     o.initialMaxLen,
+		ceilingMaxLen:     o.ceilingMaxLen,
+		mode:              o.mode,
+		lifo:              o.lifo,
+		maxBytes:          o.maxBytes,
+		sizeOf:            o.sizeOf,
+		keyFunc:           o.keyFunc,
+		observer:          o.observer,
+		deadLetter:        o.deadLetter,
+		visibilityTimeout: o.visibilityTimeout,
+		ttl:               o.ttl,
+		mu:                o.mu,
+		mutexParams:       o.mutexParams,
+		jsonEnvelope:      o.jsonEnvelope,
+	}
 }
 
 // NewQueue returns a new synced queue
@@ -47,33 +226,450 @@ func NewDroppingQueue(max int) Queue {
 	return Queue{queue: make([]interface{}, 0, max), maxLen: max, mode: modeDrop}
 }
 
-// Push pushed an object to a queue
+// NewStack returns a new synced stack, which is a queue popping the latest elements first
+func NewStack() Queue { return Queue{queue: []interface{}{}, mode: modeNormal, lifo: true} }
+
+// NewLimitedStack returns a new synced limited stack
+func NewLimitedStack(max int) Queue {
+	return Queue{queue: make([]interface{}, 0, max), maxLen: max, mode: modeNormal, lifo: true}
+}
+
+// NewElasticQueue returns a new synced queue limited by initialMax which doubles the limit instead
+// of overflowing, up to ceilingMax. The overflow policy is applied only at the ceiling.
+func NewElasticQueue(initialMax, ceilingMax int, opts ...QueueOption) Queue {
+	return NewQueueWithOptions(append(opts, QueueWithElasticMaxLen(initialMax, ceilingMax))...)
+}
+
+// NewByteLimitedQueue returns a new synced queue limited by the total size of its elements got by sizeOf.
+// The overflow policy is applied when the limit is exceeded.
+func NewByteLimitedQueue(maxBytes int, sizeOf func(interface{}) int, opts ...QueueOption) Queue {
+	return NewQueueWithOptions(append(opts, QueueWithByteLimit(maxBytes, sizeOf))...)
+}
+
+// NewQueueWithOptions returns a new synced queue configured by opts
+func NewQueueWithOptions(opts ...QueueOption) Queue { return applyQueueOptions(opts).fromPrototype() }
+
+// NewNamedQueue returns a new synced queue guarded by a Mutex named by name,
+// so the queue lock benefits from the Mutex debugging facilities
+func NewNamedQueue(name string, opts ...QueueOption) Queue {
+	o := applyQueueOptions(opts)
+	o.mutexParams.Name = name
+	o.mu = NewMutex(o.mutexParams)
+	return o.fromPrototype()
+}
+
+// Lock locks the queue. Named queues are locked with the underlying Mutex.
+func (q *Queue) Lock() {
+	if q.mu != nil {
+		q.mu.Lock()
+		return
+	}
+	q.mutex.Lock()
+}
+
+// Unlock unlocks the queue. Named queues are unlocked with the underlying Mutex.
+func (q *Queue) Unlock() {
+	if q.mu != nil {
+		q.mu.Unlock()
+		return
+	}
+	q.mutex.Unlock()
+}
+
+// TryLock locks the queue only if it is not locked and returns whether it was locked.
+// Named queues are locked with the underlying Mutex.
+func (q *Queue) TryLock() bool {
+	if q.mu != nil {
+		return q.mu.TryLock()
+	}
+	return q.mutex.TryLock()
+}
+
+// getCond returns the condition variable broadcasted on queue changes. q must be locked
+func (q *Queue) getCond() *sync.Cond {
+	if q.cond == nil {
+		q.cond = sync.NewCond(q)
+	}
+	return q.cond
+}
+
+// notify wakes up goroutines waiting for queue changes. q must be locked
+func (q *Queue) notify() {
+	if q.cond != nil {
+		q.cond.Broadcast()
+	}
+}
+
+// wait waits for queue changes until ready returns true or ctx is done. q must be locked
+func (q *Queue) wait(ctx context.Context, ready func() bool) error {
+	if ready() {
+		return nil
+	}
+	cond := q.getCond()
+	stopC := make(chan struct{})
+	defer close(stopC)
+	go func() {
+		select {
+		case <-ctx.Done():
+			q.Lock()
+			cond.Broadcast()
+			q.Unlock()
+		case <-stopC:
+		}
+	}()
+	for !ready() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		cond.Wait()
+	}
+	return nil
+}
+
+// Push pushed an object to a queue. With OverflowBlock policy it blocks until there is room
 func (q *Queue) Push(object interface{}) error {
+	return q.PushBlocking(context.Background(), object)
+}
+
+// PushReplace replaces the pending element with key by object keeping its position, or pushes object
+// as by Push if there is no such element. The key must be the one the queue key function returns for object,
+// see QueueWithKeyFunc, otherwise ErrKeyMismatch is returned. Without the key function it works as Push.
+func (q *Queue) PushReplace(key string, object interface{}) error {
 	q.Lock()
 	defer q.Unlock()
-
-	if q.maxLen == 0 || q.len() < q.maxLen {
-		q.queue = append(q.queue, object)
+	if q.keyFunc != nil && q.keyFunc(object) != key {
+		return ErrKeyMismatch
+	}
+	if i := q.indexOfKey(key); i >= 0 {
+		e := q.queue[i]
+		size := q.bytes - q.sizeOfElement(e) + q.sizeOfElement(object)
+		if q.maxBytes > 0 && size > q.maxBytes {
+			q.overflowed(object)
+			return ErrQueueOverflowed
+		}
+		q.queue[i], q.bytes = object, size
+		q.indexKey(e, -1)
+		q.indexKey(object, 1)
+		if q.ttl > 0 {
+			q.pushedAt[i] = time.Now()
+		}
+		q.notify()
 		return nil
 	}
+	_, err := q.pushWait(context.Background(), object)
+	return err
+}
+
+// indexOfKey returns the position of the pending element with key, or -1 if there is no such element
+func (q *Queue) indexOfKey(key string) int {
+	if q.keyFunc == nil || q.keys[key] == 0 {
+		return -1
+	}
+	for i, e := range q.queue {
+		if q.keyFunc(e) == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// PushBlocking pushes an object to a queue. With OverflowBlock policy it blocks until there is room
+// or ctx is done, if the policy is changed meanwhile the new one is applied.
+// Returns the context error if ctx is done before the object is pushed.
+func (q *Queue) PushBlocking(ctx context.Context, object interface{}) error {
+	q.Lock()
+	defer q.Unlock()
+	_, err := q.pushWait(ctx, object)
+	return err
+}
+
+// SetOverflowPolicy sets the behavior of the limited queue on overflow.
+// Pushes blocked by OverflowBlock policy are woken up to apply the new policy.
+func (q *Queue) SetOverflowPolicy(policy OverflowPolicy) {
+	q.Lock()
+	defer q.Unlock()
+	q.mode = int(policy)
+	q.notify()
+}
+
+// OverflowPolicy returns the behavior of the limited queue on overflow
+func (q *Queue) OverflowPolicy() OverflowPolicy {
+	q.Lock()
+	defer q.Unlock()
+	return OverflowPolicy(q.mode)
+}
+
+// PushBatchDrop pushes objects to a queue, dropping the earliest elements if needed for a dropping queue.
+// Returns dropped elements in the order they were dropped. For a non-dropping queue it stops
+// at the first object which doesn't fit and returns ErrQueueOverflowed.
+func (q *Queue) PushBatchDrop(objects ...interface{}) (dropped []interface{}, err error) {
+	q.Lock()
+	defer q.Unlock()
+	for _, object := range objects {
+		_, d, err := q.push(object)
+		dropped = append(dropped, d...)
+		if err != nil {
+			return dropped, err
+		}
+	}
+	return dropped, nil
+}
+
+// AppendSlice pushes elements to a queue in order as many as fit, without blocking.
+// Returns the number of accepted elements, which excludes the ones coalesced by key, and the elements
+// dropped by a dropping queue in the order they were dropped. For a non-dropping queue it stops
+// at the first element which doesn't fit and returns ErrQueueOverflowed.
+func (q *Queue) AppendSlice(elements []interface{}) (accepted int, dropped []interface{}, err error) {
+	q.Lock()
+	defer q.Unlock()
+	return q.appendSlice(elements)
+}
 
-	// q.maxLen > 0 && q.len() == q.maxLen
+// PushN pushes objects to a queue in order as many as fit, without blocking.
+// For a dropping queue the earliest elements are dropped as needed, and pushed is the number
+// of the objects still retained in the queue. For a non-dropping queue it stops at the first
+// object which doesn't fit and returns ErrQueueOverflowed.
+func (q *Queue) PushN(objects ...interface{}) (pushed int, err error) {
+	q.Lock()
+	defer q.Unlock()
+	queued := q.len()
+	accepted, dropped, err := q.appendSlice(objects)
+	// the earliest elements are dropped first, the objects are dropped after all the queued ones
+	if droppedObjects := len(dropped) - queued; droppedObjects > 0 {
+		accepted -= droppedObjects
+	}
+	return accepted, err
+}
+
+func (q *Queue) appendSlice(elements []interface{}) (accepted int, dropped []interface{}, err error) {
+	for _, e := range elements {
+		added, d, err := q.push(e)
+		dropped = append(dropped, d...)
+		if err != nil {
+			return accepted, dropped, err
+		}
+		if added {
+			accepted++
+		}
+	}
+	return accepted, dropped, nil
+}
+
+func (q *Queue) sizeOfElement(e interface{}) int {
+	if q.sizeOf == nil {
+		return 0
+	}
+	return q.sizeOf(e)
+}
+
+// hasRoomFor returns true if an element of size fits into the queue limits
+func (q *Queue) hasRoomFor(size int) bool {
+	return (q.maxLen == 0 || q.len() < q.maxLen) && (q.maxBytes == 0 || q.bytes+size <= q.maxBytes)
+}
+
+// grow doubles the length limit of a full elastic queue up to the ceiling
+func (q *Queue) grow() {
+	if q.ceilingMaxLen == 0 || q.maxLen == 0 || q.len() < q.maxLen || q.maxLen >= q.ceilingMaxLen {
+		return
+	}
+	q.maxLen *= 2
+	if q.maxLen > q.ceilingMaxLen {
+		q.maxLen = q.ceilingMaxLen
+	}
+}
+
+// Shrink reduces the length limit of an elastic queue to the initial one doubled as many times
+// as needed to hold the current elements, and reclaims memory. Returns resulting limit
+func (q *Queue) Shrink() int {
+	q.Lock()
+	defer q.Unlock()
+	if q.ceilingMaxLen == 0 || q.initialMaxLen == 0 {
+		return q.maxLen
+	}
+	maxLen := q.initialMaxLen
+	for maxLen < q.len() && maxLen < q.ceilingMaxLen {
+		maxLen *= 2
+	}
+	if maxLen > q.ceilingMaxLen {
+		maxLen = q.ceilingMaxLen
+	}
+	q.maxLen = maxLen
+	q.queue = q.copy()
+	return q.maxLen
+}
+
+// add appends an element of size to the queue
+func (q *Queue) add(object interface{}, size int) {
+	q.queue = append(q.queue, object)
+	q.pushed(1)
+	q.bytes += size
+	q.indexKey(object, 1)
+	q.countPushed(object)
+	q.notify()
+}
+
+// countPushed records the element pushed to the queue in the stats and notifies the observer
+func (q *Queue) countPushed(element interface{}) {
+	q.stats.Pushed++
+	if q.observer != nil {
+		q.observer.OnPush(element, q.len())
+	}
+}
+
+// overflowed notifies about the object rejected because of the queue overflow
+func (q *Queue) overflowed(object interface{}) {
+	if q.OnOverflow != nil {
+		q.OnOverflow(object)
+	}
+	if q.observer != nil {
+		q.observer.OnOverflow(object, q.len())
+	}
+}
+
+// indexKey adds delta to the number of pending elements with the key of e if the queue has a key function
+func (q *Queue) indexKey(e interface{}, delta int) {
+	if q.keyFunc == nil {
+		return
+	}
+	if q.keys == nil {
+		q.keys = make(map[string]int)
+	}
+	key := q.keyFunc(e)
+	if q.keys[key] += delta; q.keys[key] <= 0 {
+		delete(q.keys, key)
+	}
+}
+
+// reindex rebuilds the key index from the queue contents
+func (q *Queue) reindex() {
+	q.keys = nil
+	for _, e := range q.queue {
+		q.indexKey(e, 1)
+	}
+}
+
+// SetKeyFunc sets the function getting keys to coalesce pushed elements by, see QueueWithKeyFunc.
+// The key index is rebuilt from the current contents. Nil fn disables coalescing.
+func (q *Queue) SetKeyFunc(fn func(interface{}) string) {
+	q.Lock()
+	defer q.Unlock()
+	q.keyFunc = fn
+	q.reindex()
+}
+
+// coalesced returns true if an element with the same key as object is pending
+func (q *Queue) coalesced(object interface{}) bool {
+	return q.keyFunc != nil && q.keys[q.keyFunc(object)] > 0
+}
+
+// pushWait pushes an object to the queue, with OverflowBlock policy it waits for room first
+func (q *Queue) pushWait(ctx context.Context, object interface{}) ([]interface{}, error) {
+	if q.mode == modeBlock {
+		q.grow()
+		size := q.sizeOfElement(object)
+		if q.maxBytes > 0 && size > q.maxBytes {
+			q.overflowed(object)
+			return nil, ErrQueueOverflowed
+		}
+		if err := q.wait(ctx, func() bool {
+			return q.mode != modeBlock || q.coalesced(object) || q.hasRoomFor(q.sizeOfElement(object))
+		}); err != nil {
+			return nil, err
+		}
+	}
+	_, dropped, err := q.push(object)
+	return dropped, err
+}
+
+// push pushes an object to the queue applying overflow policy without blocking.
+// Returns whether the object was added, which it is not if it is coalesced by key, and dropped elements
+func (q *Queue) push(object interface{}) (added bool, dropped []interface{}, err error) {
+	if q.coalesced(object) {
+		return false, nil, nil
+	}
+	q.grow()
+	size := q.sizeOfElement(object)
+	if q.hasRoomFor(size) {
+		q.add(object, size)
+		return true, nil, nil
+	}
 
 	switch q.mode {
-	case modeNormal:
-		return ErrQueueOverflowed
+	case modeNormal, modeBlock:
+		q.overflowed(object)
+		return false, nil, ErrQueueOverflowed
 	case modeDrop:
-		if _, err := q.pop(); err != nil {
-			return ErrFailedToDrop(err)
+		if q.maxBytes > 0 && size > q.maxBytes {
+			q.overflowed(object)
+			return false, nil, ErrQueueOverflowed
 		}
-		q.queue = append(q.queue, object)
-		return nil
+		for !q.hasRoomFor(size) {
+			element, err := q.drop()
+			if err != nil {
+				return false, dropped, ErrFailedToDrop(err)
+			}
+			dropped = append(dropped, element)
+		}
+		q.add(object, size)
+		return true, dropped, nil
+	}
+	return false, nil, nil
+}
+
+// pushTop pushes elements back to where they are popped from, the front of the queue or the top of a stack,
+// preserving their order with their push times pushedAt, nil pushedAt means they are pushed now
+func (q *Queue) pushTop(pushedAt []time.Time, elements ...interface{}) error {
+	size := 0
+	for _, e := range elements {
+		size += q.sizeOfElement(e)
 	}
+	if (q.maxLen > 0 && q.len()+len(elements) > q.maxLen) || (q.maxBytes > 0 && q.bytes+size > q.maxBytes) {
+		return ErrQueueOverflowed
+	}
+	q.bytes += size
+	for _, e := range elements {
+		q.indexKey(e, 1)
+	}
+	if q.ttl > 0 && pushedAt == nil {
+		pushedAt = make([]time.Time, len(elements))
+		now := time.Now()
+		for i := range pushedAt {
+			pushedAt[i] = now
+		}
+	}
+	if q.lifo {
+		q.queue = append(q.queue, elements...)
+		if q.ttl > 0 {
+			q.pushedAt = append(q.pushedAt, pushedAt...)
+		}
+	} else {
+		capacity := q.maxLen
+		if capacity < q.len()+len(elements) {
+			capacity = q.len() + len(elements)
+		}
+		queue := make([]interface{}, 0, capacity)
+		queue = append(queue, elements...)
+		q.queue = append(queue, q.queue...)
+		if q.ttl > 0 {
+			q.pushedAt = append(append([]time.Time{}, pushedAt...), q.pushedAt...)
+		}
+	}
+	for _, e := range elements {
+		q.countPushed(e)
+	}
+	q.notify()
 	return nil
 }
 
 func (q *Queue) len() int { return len(q.queue) }
 
+// Bytes returns the total size of queue elements for a queue limited by size, or 0 otherwise
+func (q *Queue) Bytes() int {
+	q.Lock()
+	defer q.Unlock()
+	return q.bytes
+}
+
 // Len returns a queue current length
 func (q *Queue) Len() int {
 	q.Lock()
@@ -81,15 +677,140 @@ func (q *Queue) Len() int {
 	return q.len()
 }
 
-func (q *Queue) pop() (interface{}, error) {
+// removeFront removes the earliest element from the queue
+func (q *Queue) removeFront() (interface{}, error) {
 	if q.len() == 0 {
 		return nil, ErrQueueIsEmpty
 	}
 	popped := q.queue[0]
 	q.queue = q.queue[1:]
+	if q.ttl > 0 {
+		q.pushedAt = q.pushedAt[1:]
+	}
+	q.bytes -= q.sizeOfElement(popped)
+	q.indexKey(popped, -1)
+	q.notify()
+	return popped, nil
+}
+
+// top returns the index of the element to be popped next. q must not be empty
+func (q *Queue) top() int {
+	if q.lifo {
+		return q.len() - 1
+	}
+	return 0
+}
+
+// index returns the index in q.queue of the element at position i counted in the order of popping,
+// from the front of a queue or from the top of a stack
+func (q *Queue) index(i int) int {
+	if q.lifo {
+		return q.len() - 1 - i
+	}
+	return i
+}
+
+// ordered returns a copy of the queue elements in the order they are popped
+func (q *Queue) ordered() []interface{} {
+	ordered := make([]interface{}, q.len())
+	for i := range ordered {
+		ordered[i] = q.queue[q.index(i)]
+	}
+	return ordered
+}
+
+// removeTop removes the element to be popped next, the latest one for a stack
+func (q *Queue) removeTop() (interface{}, error) {
+	if q.lifo {
+		return q.removeBack()
+	}
+	return q.removeFront()
+}
+
+// removeBack removes the latest element from the queue
+func (q *Queue) removeBack() (interface{}, error) {
+	l := q.len()
+	if l == 0 {
+		return nil, ErrQueueIsEmpty
+	}
+	popped := q.queue[l-1]
+	q.queue[l-1] = nil
+	q.queue = q.queue[:l-1]
+	if q.ttl > 0 {
+		q.pushedAt = q.pushedAt[:l-1]
+	}
+	q.bytes -= q.sizeOfElement(popped)
+	q.indexKey(popped, -1)
+	q.notify()
 	return popped, nil
 }
 
+// removeAt removes the element at position i preserving order of the rest
+func (q *Queue) removeAt(i int) interface{} {
+	removed := q.queue[i]
+	copy(q.queue[i:], q.queue[i+1:])
+	q.queue[q.len()-1] = nil
+	q.queue = q.queue[:q.len()-1]
+	if q.ttl > 0 {
+		q.pushedAt = append(q.pushedAt[:i], q.pushedAt[i+1:]...)
+	}
+	q.bytes -= q.sizeOfElement(removed)
+	q.indexKey(removed, -1)
+	q.notify()
+	return removed
+}
+
+func (q *Queue) pop() (interface{}, error) {
+	q.dropExpiredTop()
+	popped, err := q.removeTop()
+	if err != nil {
+		return nil, err
+	}
+	q.popped(popped)
+	return popped, nil
+}
+
+// popped notifies about the element popped from the queue
+func (q *Queue) popped(element interface{}) {
+	q.countPopped(element)
+	q.emptied(q.len() + 1)
+}
+
+// countPopped records the element popped from the queue in the stats and notifies the observer
+func (q *Queue) countPopped(element interface{}) {
+	q.stats.Popped++
+	if q.observer != nil {
+		q.observer.OnPop(element, q.len())
+	}
+}
+
+// emptied calls OnEmpty if the queue of length n became empty
+func (q *Queue) emptied(n int) {
+	if n > 0 && q.len() == 0 && q.OnEmpty != nil {
+		q.OnEmpty()
+	}
+}
+
+// dropped notifies about the element dropped from the queue
+func (q *Queue) dropped(element interface{}) {
+	q.stats.Dropped++
+	if q.OnDrop != nil {
+		q.OnDrop(element)
+	}
+	if q.observer != nil {
+		q.observer.OnDrop(element, q.len())
+	}
+}
+
+func (q *Queue) drop() (interface{}, error) {
+	dropped, err := q.removeFront()
+	if err != nil {
+		return nil, err
+	}
+	q.dropped(dropped)
+	return dropped, nil
+}
+
 // Pop returns an object from a queue
 func (q *Queue) Pop() (interface{}, error) {
 	q.Lock()
@@ -97,7 +818,467 @@ func (q *Queue) Pop() (interface{}, error) {
 	return q.pop()
 }
 
-// Clear the queue
+// PopWait pops an object from a queue waiting until the queue is not empty,
+// or returns ctx.Err() if ctx is done before. Each pushed element wakes up the waiting goroutines,
+// and only one of them pops it, while the rest keep waiting.
+func (q *Queue) PopWait(ctx context.Context) (interface{}, error) {
+	q.Lock()
+	defer q.Unlock()
+	for {
+		if err := q.wait(ctx, q.nonEmpty); err != nil {
+			return nil, err
+		}
+		// the queue may become empty again if all its elements have expired
+		if popped, err := q.pop(); err == nil {
+			return popped, nil
+		}
+	}
+}
+
+// PopWhile pops elements from a queue while they satisfy pred. The first element not satisfying it stays queued
+func (q *Queue) PopWhile(pred func(interface{}) bool) []interface{} {
+	q.Lock()
+	defer q.Unlock()
+	var popped []interface{}
+	for q.nonEmpty() && pred(q.queue[q.top()]) {
+		element, _ := q.pop()
+		popped = append(popped, element)
+	}
+	return popped
+}
+
+// Seek drops elements from the front of the queue, or from the top of a stack, until one satisfies pred, then pops and returns it.
+// OnDrop is called for each dropped element. Returns ErrQueueIsEmpty if no element satisfies pred,
+// all elements are dropped then.
+func (q *Queue) Seek(pred func(interface{}) bool) (interface{}, error) {
+	q.Lock()
+	defer q.Unlock()
+	for q.nonEmpty() {
+		if pred(q.queue[q.top()]) {
+			return q.pop()
+		}
+		element, _ := q.removeTop()
+		q.dropped(element)
+		q.emptied(q.len() + 1)
+	}
+	return nil, ErrQueueIsEmpty
+}
+
+// PopMatch pops the first element satisfying pred in the order of popping wherever it is, preserving order of the rest.
+// Returns ErrQueueIsEmpty if the queue is empty, or ErrNoMatch if no element satisfies pred
+func (q *Queue) PopMatch(pred func(interface{}) bool) (interface{}, error) {
+	q.Lock()
+	defer q.Unlock()
+	q.dropExpired()
+	if q.len() == 0 {
+		return nil, ErrQueueIsEmpty
+	}
+	for i := 0; i < q.len(); i++ {
+		if !pred(q.queue[q.index(i)]) {
+			continue
+		}
+		popped := q.removeAt(q.index(i))
+		q.popped(popped)
+		return popped, nil
+	}
+	return nil, ErrNoMatch
+}
+
+// PopOrDefault returns an object from a queue and true, or def and false if the queue is empty
+func (q *Queue) PopOrDefault(def interface{}) (interface{}, bool) {
+	q.Lock()
+	defer q.Unlock()
+	popped, err := q.pop()
+	if err != nil {
+		return def, false
+	}
+	return popped, true
+}
+
+// PollN waits until n elements are available or the queue is full, then pops up to n elements.
+// If ctx is done before, it pops the elements available at that moment, possibly fewer than n.
+// Returns ctx.Err() only if ctx is done while the queue is empty.
+func (q *Queue) PollN(ctx context.Context, n int) ([]interface{}, error) {
+	q.Lock()
+	defer q.Unlock()
+	err := q.wait(ctx, func() bool { return q.len() >= n || (q.maxLen > 0 && q.len() >= q.maxLen) })
+	if err != nil && q.len() == 0 {
+		return nil, err
+	}
+	var popped []interface{}
+	for len(popped) < n {
+		element, err := q.pop()
+		if err != nil {
+			break
+		}
+		popped = append(popped, element)
+	}
+	return popped, nil
+}
+
+// PopN pops up to n elements from a queue under a single lock. Returns fewer elements
+// if the queue is shorter, and an empty slice if it is empty
+func (q *Queue) PopN(n int) ([]interface{}, error) {
+	q.Lock()
+	defer q.Unlock()
+	if n > q.len() {
+		n = q.len()
+	}
+	if n < 0 {
+		n = 0
+	}
+	popped := make([]interface{}, 0, n)
+	for len(popped) < n {
+		element, err := q.pop()
+		if err != nil {
+			break
+		}
+		popped = append(popped, element)
+	}
+	return popped, nil
+}
+
+// DropOldest drops up to n earliest elements from the queue and returns them
+func (q *Queue) DropOldest(n int) []interface{} {
+	q.Lock()
+	defer q.Unlock()
+	switch {
+	case n < 0:
+		n = 0
+	case n > q.len():
+		n = q.len()
+	}
+	dropped := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		element, _ := q.drop()
+		dropped = append(dropped, element)
+	}
+	q.emptied(n)
+	return dropped
+}
+
+// Each calls fn for each element of a point-in-time snapshot of the queue contents in the order
+// they are popped, as by Snapshot. The lock is held only while taking the snapshot, so fn may be slow
+// and may call the queue methods, but changes made after the snapshot are not seen by the iteration.
+func (q *Queue) Each(fn func(e interface{})) {
+	q.Lock()
+	q.dropExpired()
+	snapshot := q.ordered()
+	q.Unlock()
+	for _, e := range snapshot {
+		fn(e)
+	}
+}
+
+// Range calls fn for each element in the order they are popped under the lock, i is the position as by At.
+// Elements for which fn returns keep=false are removed from the queue preserving order of the rest,
+// they are counted as popped.
+// Iteration halts when fn returns stop=true.
+func (q *Queue) Range(fn func(i int, e interface{}) (keep bool, stop bool)) {
+	q.Lock()
+	defer q.Unlock()
+	n := q.len()
+	remove := make([]bool, n)
+	for i := 0; i < n; i++ {
+		keep, stop := fn(i, q.queue[q.index(i)])
+		remove[q.index(i)] = !keep
+		if stop {
+			break
+		}
+	}
+	kept := make([]interface{}, 0, cap(q.queue))
+	keptAt := q.pushedAt[:0]
+	var removed []interface{}
+	for i, e := range q.queue {
+		if !remove[i] {
+			kept = append(kept, e)
+			if q.ttl > 0 {
+				keptAt = append(keptAt, q.pushedAt[i])
+			}
+			continue
+		}
+		q.bytes -= q.sizeOfElement(e)
+		q.indexKey(e, -1)
+		removed = append(removed, e)
+	}
+	q.queue, q.pushedAt = kept, keptAt
+	for _, e := range removed {
+		q.countPopped(e)
+	}
+	q.notify()
+	q.emptied(n)
+}
+
+// RequeueError is returned by Flush if the elements of the failed batch no longer fit into the queue limits
+type RequeueError struct {
+	Err      error         // the error of pushing the elements back
+	Cause    error         // the error returned by the flush function
+	Elements []interface{} // the elements not pushed back, in original order
+}
+
+// Error implements error
+func (e RequeueError) Error() string { return ErrFailedToRequeue(e.Err, e.Cause).Error() }
+
+// Unwrap returns the error returned by the flush function
+func (e RequeueError) Unwrap() error { return e.Cause }
+
+// Flush drains the queue and calls fn with all drained elements. The queue is not locked while fn runs.
+// If fn returns an error, the elements are pushed back to the front of the queue, or the top of a stack,
+// in original order and the error is returned. If they no longer fit into the queue limits,
+// the earliest of them fitting are pushed back and RequeueError holding the rest is returned.
+func (q *Queue) Flush(fn func(batch []interface{}) error) error {
+	batch, batchPushedAt := func() ([]interface{}, []time.Time) {
+		q.Lock()
+		defer q.Unlock()
+		batch, batchPushedAt := q.takeContents()
+		q.notify()
+		q.emptied(len(batch))
+		return batch, batchPushedAt
+	}()
+	if len(batch) == 0 {
+		return nil
+	}
+	err := fn(batch)
+	if err == nil {
+		return nil
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	n := q.fitting(batch)
+	if batchPushedAt != nil {
+		batchPushedAt = batchPushedAt[:n]
+	}
+	if requeueErr := q.pushTop(batchPushedAt, batch[:n]...); requeueErr != nil {
+		return RequeueError{Err: requeueErr, Cause: err, Elements: batch}
+	}
+	if n < len(batch) {
+		return RequeueError{Err: ErrQueueOverflowed, Cause: err, Elements: batch[n:]}
+	}
+	return err
+}
+
+// takeContents empties the queue counting its elements as popped, and returns them with their push times.
+// q must be locked
+func (q *Queue) takeContents() ([]interface{}, []time.Time) {
+	elements, pushedAt := q.queue, q.pushedAt
+	q.queue = make([]interface{}, 0, q.maxLen)
+	q.pushedAt = nil
+	q.bytes = 0
+	q.keys = nil
+	for _, e := range elements {
+		q.countPopped(e)
+	}
+	return elements, pushedAt
+}
+
+// fitting returns the number of the earliest elements fitting into the queue limits at once
+func (q *Queue) fitting(elements []interface{}) int {
+	n := len(elements)
+	if room := q.maxLen - q.len(); q.maxLen > 0 && room < n {
+		n = room
+	}
+	if n < 0 {
+		return 0
+	}
+	size := q.bytes
+	for i := 0; q.maxBytes > 0 && i < n; i++ {
+		if size += q.sizeOfElement(elements[i]); size > q.maxBytes {
+			return i
+		}
+	}
+	return n
+}
+
+// SetDeadLetter sets the queue receiving elements which exceeded the retry limit, see RequeueOrDeadLetter.
+// Nil dlq detaches the dead-letter queue.
+func (q *Queue) SetDeadLetter(dlq *Queue) {
+	q.Lock()
+	defer q.Unlock()
+	q.deadLetter = dlq
+}
+
+// DeadLetter returns the dead-letter queue or nil if it was not set
+func (q *Queue) DeadLetter() *Queue {
+	q.Lock()
+	defer q.Unlock()
+	return q.deadLetter
+}
+
+// RequeueOrDeadLetter pushes the element failed failCount times back to the front of the queue, or the top of a stack,
+// if failCount is less than max, otherwise it pushes the element to the dead-letter queue.
+// Returns ErrNoDeadLetter if the element should be dead-lettered but the dead-letter queue was not set.
+func (q *Queue) RequeueOrDeadLetter(element interface{}, failCount int, max int) error {
+	q.Lock()
+	if failCount < max {
+		defer q.Unlock()
+		return q.pushTop(nil, element)
+	}
+	dlq := q.deadLetter
+	q.Unlock()
+	if dlq == nil {
+		return ErrNoDeadLetter
+	}
+	return dlq.Push(element)
+}
+
+// SwapContents replaces the queue contents with elements and returns the previous contents.
+// Elements are pushed as by Push: a dropping queue drops the earliest of them not fitting into the limits,
+// while other queues reject the latest of them.
+func (q *Queue) SwapContents(elements []interface{}) []interface{} {
+	q.Lock()
+	defer q.Unlock()
+	previous, _ := q.takeContents()
+	for _, e := range elements {
+		_, _, _ = q.push(e)
+	}
+	q.notify()
+	q.emptied(len(previous))
+	return previous
+}
+
+// Resize sets the queue length limit to newMax, 0 means no limit and negative newMax is treated as 0.
+// For an elastic queue newMax also becomes the ceiling it grows up to. If the queue is longer than newMax,
+// the extra elements are dropped from the front (the earliest ones) if fromFront is true,
+// or from the back (the latest ones) otherwise. OnDrop is called for each dropped element.
+// Returns dropped elements in the order they were dropped.
+func (q *Queue) Resize(newMax int, fromFront bool) []interface{} {
+	q.Lock()
+	defer q.Unlock()
+	if newMax < 0 {
+		newMax = 0
+	}
+	n := q.len()
+	q.maxLen = newMax
+	if q.ceilingMaxLen > 0 {
+		q.ceilingMaxLen = newMax
+		if q.initialMaxLen > newMax {
+			q.initialMaxLen = newMax
+		}
+	}
+	var dropped []interface{}
+	for newMax > 0 && q.len() > newMax {
+		var element interface{}
+		if fromFront {
+			element, _ = q.removeFront()
+		} else {
+			element, _ = q.removeBack()
+		}
+		q.dropped(element)
+		dropped = append(dropped, element)
+	}
+	q.notify()
+	q.emptied(n)
+	return dropped
+}
+
+// lockWith locks both q and other in the order of their addresses to avoid deadlocks.
+// Returns a function unlocking them
+func (q *Queue) lockWith(other *Queue) (unlock func()) {
+	first, second := q, other
+	if uintptr(unsafe.Pointer(second)) < uintptr(unsafe.Pointer(first)) {
+		first, second = second, first
+	}
+	first.Lock()
+	second.Lock()
+	return func() {
+		second.Unlock()
+		first.Unlock()
+	}
+}
+
+// moveTo moves elements of q to dst as by dst.Push until q is empty or dst overflows. q and dst must be locked
+func (q *Queue) moveTo(dst *Queue) error {
+	defer q.emptied(q.len())
+	for q.len() > 0 {
+		if _, _, err := dst.push(q.queue[0]); err != nil {
+			return err
+		}
+		element, _ := q.removeFront()
+		q.countPopped(element)
+	}
+	return nil
+}
+
+// Merge drains srcs in order into dst, pushing elements as by dst.Push so dst limits and mode apply.
+// If dst overflows, Merge stops leaving the rest of elements in their source queue and returns the error.
+func Merge(dst *Queue, srcs ...*Queue) error {
+	for _, src := range srcs {
+		if src == dst {
+			continue
+		}
+		err := func() error {
+			defer src.lockWith(dst)()
+			return src.moveTo(dst)
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats returns the accumulated statistics of queue operations
+func (q *Queue) Stats() QueueStats {
+	q.Lock()
+	defer q.Unlock()
+	stats := q.stats
+	stats.Len = q.len()
+	return stats
+}
+
+// QueueReport is a consistent snapshot of the queue state and statistics
+type QueueReport struct {
+	// Len is the queue length
+	Len int `json:"len"`
+	// Cap is the queue length limit, 0 if the queue is not limited
+	Cap int `json:"cap"`
+	// Mode is the overflow policy name
+	Mode string `json:"mode"`
+	// Pushed is the number of pushed elements
+	Pushed uint64 `json:"pushed"`
+	// Popped is the number of popped elements
+	Popped uint64 `json:"popped"`
+	// Dropped is the number of dropped elements
+	Dropped uint64 `json:"dropped"`
+	// OldestAge is the time since the earliest element was pushed. Push times are recorded only
+	// by a queue with TTL, see QueueWithTTL, so it is always 0 and left out of JSON for other queues
+	OldestAge time.Duration `json:"oldestAge,omitempty"`
+	// FillRatio is Len divided by Cap, 0 if the queue is not limited
+	FillRatio float64 `json:"fillRatio"`
+}
+
+// Report returns the queue state and statistics got under a single lock, so they are consistent
+func (q *Queue) Report() QueueReport {
+	q.Lock()
+	defer q.Unlock()
+	r := QueueReport{
+		Len:     q.len(),
+		Cap:     q.maxLen,
+		Mode:    queueModeNames[q.mode],
+		Pushed:  q.stats.Pushed,
+		Popped:  q.stats.Popped,
+		Dropped: q.stats.Dropped,
+	}
+	now := time.Now()
+	for _, pushedAt := range q.pushedAt {
+		if age := now.Sub(pushedAt); age > r.OldestAge {
+			r.OldestAge = age
+		}
+	}
+	if q.maxLen > 0 {
+		r.FillRatio = float64(r.Len) / float64(q.maxLen)
+	}
+	return r
+}
+
+// PublishExpvar publishes the queue statistics returned by Stats to expvar under name,
+// so they are exposed on /debug/vars. Like expvar.Publish, it panics if name is already published.
+func (q *Queue) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} { return q.Stats() }))
+}
+
+// Clear the queue, its elements are counted as popped. The queue limit and mode are preserved
 func (q *Queue) Clear() {
 	q.Lock()
 	defer q.Unlock()
@@ -106,7 +1287,23 @@ func (q *Queue) Clear() {
 	}
 }
 
+// Drain pops all elements from a queue at once and returns them in the order they are popped
+func (q *Queue) Drain() []interface{} {
+	q.Lock()
+	defer q.Unlock()
+	drained := make([]interface{}, 0, q.len())
+	for q.len() > 0 {
+		element, err := q.pop()
+		if err != nil {
+			break
+		}
+		drained = append(drained, element)
+	}
+	return drained
+}
+
 func (q *Queue) get(pos int) (interface{}, error) {
+	q.dropExpired()
 	l := q.len()
 	switch {
 	case l == 0:
@@ -119,18 +1316,128 @@ func (q *Queue) get(pos int) (interface{}, error) {
 			return nil, ErrOutOfBounds
 		}
 	}
-	return q.queue[pos], nil
+	return q.queue[q.index(pos)], nil
+}
+
+// GetWait waits until the queue is not empty and returns the element to be popped next without popping it,
+// the earliest one or the latest one for a stack,
+// or returns ctx.Err() if ctx is done before
+func (q *Queue) GetWait(ctx context.Context) (interface{}, error) {
+	q.Lock()
+	defer q.Unlock()
+	if err := q.wait(ctx, q.nonEmpty); err != nil {
+		return nil, err
+	}
+	return q.get(0)
 }
 
-// Get element at position pos but don't pop it, 0 is the most early element, -1 is the latest
+// Get element at position pos but don't pop it, 0 is the most early element, -1 is the latest.
+// For a stack positions are counted from the top, so 0 is the latest element
 func (q *Queue) Get(pos int) (interface{}, error) {
 	q.Lock()
 	defer q.Unlock()
 	return q.get(pos)
 }
 
-// List elements at positions i but don't pop them, 0 is the most early element, -1 is the latest
-// it returns element in the same order as indexes
+// At returns the element at index i from the front, or from the top of a stack, without popping it,
+// or ErrOutOfBounds if i is out of range
+func (q *Queue) At(i int) (interface{}, error) {
+	q.Lock()
+	defer q.Unlock()
+	q.dropExpired()
+	if i < 0 || i >= q.len() {
+		return nil, ErrOutOfBounds
+	}
+	return q.queue[q.index(i)], nil
+}
+
+// Snapshot returns a copy of the queue elements in the order they are popped,
+// from the earliest to the latest, or from the top of a stack
+func (q *Queue) Snapshot() []interface{} {
+	q.Lock()
+	defer q.Unlock()
+	q.dropExpired()
+	return q.ordered()
+}
+
+func (q *Queue) copy() []interface{} {
+	capacity := q.maxLen
+	if capacity < q.len() {
+		capacity = q.len()
+	}
+	c := make([]interface{}, q.len(), capacity)
+	copy(c, q.queue)
+	return c
+}
+
+// Clone returns a new independent queue with a copy of the contents and the same limit and mode.
+// A clone of a named queue gets its own Mutex with the same parameters.
+func (q *Queue) Clone() Queue {
+	q.Lock()
+	defer q.Unlock()
+	var mu *Mutex
+	if q.mu != nil {
+		mu = NewMutex(q.mutexParams)
+	}
+	var keys map[string]int
+	if q.keys != nil {
+		keys = make(map[string]int, len(q.keys))
+		for key, n := range q.keys {
+			keys[key] = n
+		}
+	}
+	return Queue{
+		queue:             q.copy(),
+		maxLen:            q.maxLen,
+		initialMaxLen:     q.initialMaxLen,
+		ceilingMaxLen:     q.ceilingMaxLen,
+		mode:              q.mode,
+		lifo:              q.lifo,
+		maxBytes:          q.maxBytes,
+		bytes:             q.bytes,
+		sizeOf:            q.sizeOf,
+		keyFunc:           q.keyFunc,
+		keys:              keys,
+		observer:          q.observer,
+		deadLetter:        q.deadLetter,
+		visibilityTimeout: q.visibilityTimeout,
+		ttl:               q.ttl,
+		pushedAt:          append([]time.Time(nil), q.pushedAt...),
+		mu:                mu,
+		mutexParams:       q.mutexParams,
+		jsonEnvelope:      q.jsonEnvelope,
+	}
+}
+
+// IndexFunc returns the position of the first element satisfying pred, or -1.
+// Positions are counted as by At, 0 is the most early element, or the latest one for a stack
+func (q *Queue) IndexFunc(pred func(interface{}) bool) int {
+	q.Lock()
+	defer q.Unlock()
+	q.dropExpired()
+	for i := 0; i < q.len(); i++ {
+		if pred(q.queue[q.index(i)]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// HeadTail returns the element to be popped first and the one to be popped last, the earliest and the latest
+// elements, or the latest and the earliest ones for a stack, and the queue length, or ErrQueueIsEmpty
+func (q *Queue) HeadTail() (head, tail interface{}, n int, err error) {
+	q.Lock()
+	defer q.Unlock()
+	q.dropExpired()
+	n = q.len()
+	if n == 0 {
+		return nil, nil, 0, ErrQueueIsEmpty
+	}
+	return q.queue[q.index(0)], q.queue[q.index(n-1)], n, nil
+}
+
+// List elements at positions i but don't pop them, 0 is the most early element, -1 is the latest,
+// for a stack positions are counted from the top as by Get. It returns element in the same order as indexes
 func (q *Queue) List(positions ...int) ([]interface{}, error) {
 	q.Lock()
 	defer q.Unlock()
@@ -144,3 +1451,101 @@ func (q *Queue) List(positions ...int) ([]interface{}, error) {
 	}
 	return result, nil
 }
+
+// queueModeNames maps queue modes to their JSON names
+var queueModeNames = map[int]string{
+	modeNormal: "normal",
+	modeDrop:   "drop",
+	modeBlock:  "block",
+}
+
+// queueEnvelope is a JSON representation of a queue with its configuration
+type queueEnvelope struct {
+	Mode     string        `json:"mode"`
+	MaxLen   int           `json:"maxLen"`
+	LIFO     bool          `json:"lifo,omitempty"`
+	Elements []interface{} `json:"elements"`
+}
+
+// MarshalJSON implements json.Marshaler
+func (q *Queue) MarshalJSON() ([]byte, error) {
+	q.Lock()
+	defer q.Unlock()
+	if !q.jsonEnvelope {
+		return json.Marshal(q.queue)
+	}
+	return json.Marshal(queueEnvelope{
+		Mode: queueModeNames[q.mode], MaxLen: q.maxLen, LIFO: q.lifo, Elements: q.queue,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It accepts both a plain array of elements
+// and an object produced by a queue with QueueWithJSONEnvelope option
+func (q *Queue) UnmarshalJSON(data []byte) error {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var elements []interface{}
+		if err := json.Unmarshal(data, &elements); err != nil {
+			return err
+		}
+		q.Lock()
+		defer q.Unlock()
+		return q.restore(elements, q.maxLen, q.mode)
+	}
+
+	var envelope queueEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return err
+	}
+	mode := -1
+	for m, name := range queueModeNames {
+		if name == envelope.Mode {
+			mode = m
+		}
+	}
+	if mode < 0 {
+		return fmt.Errorf("unknown queue mode %q", envelope.Mode)
+	}
+	q.Lock()
+	defer q.Unlock()
+	q.jsonEnvelope, q.lifo = true, envelope.LIFO
+	return q.restore(envelope.Elements, envelope.MaxLen, mode)
+}
+
+// restore replaces the queue contents with elements and sets its limit and mode.
+// Dropping queue keeps only the latest elements fitting into the limits.
+// The previous elements are counted as popped and the restored ones as pushed, as by SwapContents.
+func (q *Queue) restore(elements []interface{}, maxLen, mode int) error {
+	if maxLen > 0 && len(elements) > maxLen {
+		if mode != modeDrop {
+			return ErrQueueOverflowed
+		}
+		elements = elements[len(elements)-maxLen:]
+	}
+	size := 0
+	for _, e := range elements {
+		size += q.sizeOfElement(e)
+	}
+	for q.maxBytes > 0 && size > q.maxBytes {
+		if mode != modeDrop {
+			return ErrQueueOverflowed
+		}
+		size -= q.sizeOfElement(elements[0])
+		elements = elements[1:]
+	}
+	previous, _ := q.takeContents()
+	q.maxLen, q.mode, q.bytes = maxLen, mode, size
+	capacity := maxLen
+	if capacity < len(elements) {
+		capacity = len(elements)
+	}
+	q.queue = make([]interface{}, len(elements), capacity)
+	copy(q.queue, elements)
+	q.pushed(len(elements))
+	q.reindex()
+	for _, e := range elements {
+		q.countPushed(e)
+	}
+	q.notify()
+	q.emptied(len(previous))
+	return nil
+}
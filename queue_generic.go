@@ -0,0 +1,44 @@
+package synced
+
+// TypedQueue is a thread-safe queue of elements of type T. It works like Queue
+// without type assertions at call sites
+type TypedQueue[T any] struct {
+	q Queue
+}
+
+// NewTypedQueue returns a new synced queue of elements of type T
+func NewTypedQueue[T any]() TypedQueue[T] { return TypedQueue[T]{q: NewQueue()} }
+
+// NewLimitedTypedQueue returns a new synced limited queue of elements of type T
+func NewLimitedTypedQueue[T any](max int) TypedQueue[T] {
+	return TypedQueue[T]{q: NewLimitedQueue(max)}
+}
+
+// NewDroppingTypedQueue returns a new synced dropping queue of elements of type T
+func NewDroppingTypedQueue[T any](max int) TypedQueue[T] {
+	return TypedQueue[T]{q: NewDroppingQueue(max)}
+}
+
+// typed returns element as T, or the zero value of T and err if err is not nil
+func typed[T any](element interface{}, err error) (T, error) {
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	// nil element of an interface type T is its zero value, the assertion would fail on it
+	v, _ := element.(T)
+	return v, nil
+}
+
+// Push pushes an object to a queue
+func (q *TypedQueue[T]) Push(object T) error { return q.q.Push(object) }
+
+// Pop returns an object from a queue, or the zero value of T and ErrQueueIsEmpty if the queue is empty
+func (q *TypedQueue[T]) Pop() (T, error) { return typed[T](q.q.Pop()) }
+
+// Get element at position pos but don't pop it, 0 is the most early element, -1 is the latest, see Queue.Get.
+// Returns the zero value of T and an error if there is no such element
+func (q *TypedQueue[T]) Get(pos int) (T, error) { return typed[T](q.q.Get(pos)) }
+
+// Len returns a queue current length
+func (q *TypedQueue[T]) Len() int { return q.q.Len() }
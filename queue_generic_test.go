@@ -0,0 +1,14 @@
+package synced
+
+import "testing"
+
+func TestTypedQueueNilInterfaceElement(t *testing.T) {
+	q := NewTypedQueue[error]()
+	if err := q.Push(nil); err != nil {
+		t.Fatal(err)
+	}
+	e, err := q.Pop()
+	if err != nil || e != nil {
+		t.Fatalf("Pop returned %v, %v, want nil element", e, err)
+	}
+}
@@ -0,0 +1,69 @@
+package synced
+
+import "time"
+
+// ReservePop pops an element from the queue keeping it in flight until ack or nack is called.
+// Ack discards the element, nack pushes it back to the front of the queue, or the top of a stack.
+// Only the first call of either of them takes effect. If the queue has a visibility timeout,
+// see QueueWithVisibilityTimeout, the element is nacked automatically when it expires.
+// If a nacked element no longer fits into the queue limits, it is dropped.
+func (q *Queue) ReservePop() (element interface{}, ack func(), nack func(), err error) {
+	q.Lock()
+	defer q.Unlock()
+	q.dropExpiredTop()
+	var pushedAt []time.Time // the element keeps its push time when nacked
+	if q.ttl > 0 && q.len() > 0 {
+		pushedAt = []time.Time{q.pushedAt[q.top()]}
+	}
+	element, err = q.pop()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if q.inFlight == nil {
+		q.inFlight = make(map[uint64]interface{})
+	}
+	q.lastInFlightID++
+	id := q.lastInFlightID
+	q.inFlight[id] = element
+
+	var timer *time.Timer
+	ack = func() {
+		q.Lock()
+		defer q.Unlock()
+		q.settle(id, timer)
+	}
+	nack = func() {
+		q.Lock()
+		defer q.Unlock()
+		if !q.settle(id, timer) {
+			return
+		}
+		if err := q.pushTop(pushedAt, element); err != nil {
+			q.dropped(element)
+		}
+	}
+	if q.visibilityTimeout > 0 {
+		timer = time.AfterFunc(q.visibilityTimeout, nack)
+	}
+	return element, ack, nack, nil
+}
+
+// settle removes the reservation id from the in-flight set and stops its visibility timer.
+// Returns false if it was already settled. q must be locked
+func (q *Queue) settle(id uint64, timer *time.Timer) bool {
+	if _, ok := q.inFlight[id]; !ok {
+		return false
+	}
+	delete(q.inFlight, id)
+	if timer != nil {
+		timer.Stop()
+	}
+	return true
+}
+
+// InFlight returns the number of elements reserved by ReservePop and not acknowledged yet
+func (q *Queue) InFlight() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.inFlight)
+}
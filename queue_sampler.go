@@ -0,0 +1,78 @@
+package synced
+
+import "time"
+
+// DepthSample is a queue length sampled at a moment
+type DepthSample struct {
+	Time time.Time
+	Len  int
+}
+
+// sample adds the current queue length to the samples ring
+func (q *Queue) sample() {
+	q.Lock()
+	defer q.Unlock()
+	if cap(q.samples) == 0 {
+		return
+	}
+	s := DepthSample{Time: time.Now(), Len: q.len()}
+	if len(q.samples) < cap(q.samples) {
+		q.samples = append(q.samples, s)
+		return
+	}
+	q.samples[q.samplesPos] = s
+	q.samplesPos = (q.samplesPos + 1) % len(q.samples)
+}
+
+// StartSampler starts sampling the queue length every interval keeping the last n samples,
+// see DepthSamples. A sampler started before is stopped and its samples are discarded.
+// It should be stopped with StopSampler. At least one sample is kept, and samples are taken
+// at least a millisecond apart however short interval is.
+func (q *Queue) StartSampler(interval time.Duration, n int) {
+	q.Lock()
+	defer q.Unlock()
+	q.stopDepthSampler()
+	if n < 1 {
+		n = 1
+	}
+	q.samples, q.samplesPos = make([]DepthSample, 0, n), 0
+	ticker := time.NewTicker(clampInterval(interval))
+	stopC := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				q.sample()
+			case <-stopC:
+				return
+			}
+		}
+	}()
+	q.stopSampler = func() {
+		ticker.Stop()
+		close(stopC)
+	}
+}
+
+func (q *Queue) stopDepthSampler() {
+	if q.stopSampler != nil {
+		q.stopSampler()
+		q.stopSampler = nil
+	}
+}
+
+// StopSampler stops the queue length sampler if it was started. The samples are kept
+func (q *Queue) StopSampler() {
+	q.Lock()
+	defer q.Unlock()
+	q.stopDepthSampler()
+}
+
+// DepthSamples returns the queue length samples from the earliest to the latest
+func (q *Queue) DepthSamples() []DepthSample {
+	q.Lock()
+	defer q.Unlock()
+	samples := make([]DepthSample, 0, len(q.samples))
+	samples = append(samples, q.samples[q.samplesPos:]...)
+	return append(samples, q.samples[:q.samplesPos]...)
+}
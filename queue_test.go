@@ -0,0 +1,684 @@
+package synced
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueWorkersSkipExpired(t *testing.T) {
+	q := NewQueueWithOptions(QueueWithTTL(20 * time.Millisecond))
+	if err := q.Push(1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	var mu sync.Mutex
+	var handled []interface{}
+	w := q.StartWorkers(1, func(e interface{}) {
+		mu.Lock()
+		handled = append(handled, e)
+		mu.Unlock()
+	})
+	time.Sleep(10 * time.Millisecond)
+	if err := q.Push(2); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := w.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(handled) != 1 || handled[0] != 2 {
+		t.Fatalf("handled %v, want [2]", handled)
+	}
+}
+
+func TestQueuePopWhileSkipsExpired(t *testing.T) {
+	q := NewQueueWithOptions(QueueWithTTL(20 * time.Millisecond))
+	_ = q.Push(1)
+	time.Sleep(30 * time.Millisecond)
+	_ = q.Push(100)
+	popped := q.PopWhile(func(e interface{}) bool { return e.(int) < 10 })
+	if len(popped) != 0 {
+		t.Fatalf("popped %v, want none", popped)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if popped := q.PopWhile(func(interface{}) bool { return true }); len(popped) != 0 {
+		t.Fatalf("popped %v from expired queue, want none", popped)
+	}
+}
+
+func TestQueueSeekSkipsExpired(t *testing.T) {
+	q := NewQueueWithOptions(QueueWithTTL(20 * time.Millisecond))
+	_ = q.Push(1)
+	time.Sleep(30 * time.Millisecond)
+	_ = q.Push(2)
+	if e, err := q.Seek(func(e interface{}) bool { return e == 1 }); err == nil {
+		t.Fatalf("Seek returned expired %v", e)
+	}
+}
+
+func TestQueueGetAndHeadTailSkipExpired(t *testing.T) {
+	q := NewQueueWithOptions(QueueWithTTL(20 * time.Millisecond))
+	_ = q.Push(1)
+	time.Sleep(30 * time.Millisecond)
+	if _, _, _, err := q.HeadTail(); err != ErrQueueIsEmpty {
+		t.Fatalf("HeadTail error %v, want %v", err, ErrQueueIsEmpty)
+	}
+	_ = q.Push(1)
+	time.Sleep(30 * time.Millisecond)
+	_ = q.Push(2)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if e, err := q.GetWait(ctx); err != nil || e != 2 {
+		t.Fatalf("GetWait returned %v, %v, want 2", e, err)
+	}
+}
+
+func TestQueueRequeueKeepsPushTime(t *testing.T) {
+	q := NewQueueWithOptions(QueueWithTTL(40 * time.Millisecond))
+	_ = q.Push(1)
+	time.Sleep(30 * time.Millisecond)
+	_ = q.Push(2)
+	_, _, nack, err := q.ReservePop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nack()
+	time.Sleep(20 * time.Millisecond)
+	if e, err := q.Pop(); err != nil || e != 2 {
+		t.Fatalf("Pop returned %v, %v, want 2 as the requeued 1 has expired", e, err)
+	}
+
+	_ = q.Push(3)
+	time.Sleep(30 * time.Millisecond)
+	_ = q.Push(4)
+	err = q.Flush(func([]interface{}) error { return errors.New("failed") })
+	if err == nil {
+		t.Fatal("Flush error expected")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if e, err := q.Pop(); err != nil || e != 4 {
+		t.Fatalf("Pop returned %v, %v, want 4 as the requeued 3 has expired", e, err)
+	}
+}
+
+func TestQueuePushReplace(t *testing.T) {
+	q := NewQueueWithOptions(QueueWithKeyFunc(func(e interface{}) string { return e.(string)[:1] }))
+	if err := q.PushReplace("a", "b1"); err != ErrKeyMismatch {
+		t.Fatalf("PushReplace error %v, want %v", err, ErrKeyMismatch)
+	}
+	if err := q.PushReplace("a", "a1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.PushReplace("a", "a2"); err != nil {
+		t.Fatal(err)
+	}
+	_ = q.Push("a3")
+	_ = q.Push("b1")
+	_ = q.Push("b2")
+	if got := q.Snapshot(); len(got) != 2 || got[0] != "a2" || got[1] != "b1" {
+		t.Fatalf("queue contents %v, want [a2 b1]", got)
+	}
+}
+
+func TestStackRequeueOnTop(t *testing.T) {
+	s := NewStack()
+	_, _ = s.PushN(1, 2, 3)
+	e, _, nack, err := s.ReservePop()
+	if err != nil || e != 3 {
+		t.Fatalf("ReservePop returned %v, %v, want 3", e, err)
+	}
+	nack()
+	if e, err := s.Pop(); err != nil || e != 3 {
+		t.Fatalf("Pop after nack returned %v, %v, want 3", e, err)
+	}
+
+	_ = s.RequeueOrDeadLetter(3, 0, 1)
+	if e, err := s.Pop(); err != nil || e != 3 {
+		t.Fatalf("Pop after requeue returned %v, %v, want 3", e, err)
+	}
+
+	_ = s.Push(3)
+	_ = s.Flush(func([]interface{}) error { return errors.New("failed") })
+	if got := s.Drain(); len(got) != 3 || got[0] != 3 || got[1] != 2 || got[2] != 1 {
+		t.Fatalf("Drain after Flush returned %v, want [3 2 1]", got)
+	}
+}
+
+func TestStackJSONEnvelope(t *testing.T) {
+	s := NewQueueWithOptions(QueueWithLIFO(), QueueWithJSONEnvelope())
+	_, _ = s.PushN(1.0, 2.0)
+	data, err := s.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := NewQueue()
+	if err := decoded.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := decoded.Pop(); err != nil || e != 2.0 {
+		t.Fatalf("Pop of decoded stack returned %v, %v, want 2", e, err)
+	}
+}
+
+func TestStackOrder(t *testing.T) {
+	s := NewStack()
+	for i := 1; i <= 3; i++ {
+		_ = s.Push(i)
+	}
+	if e, _ := s.Get(0); e != 3 {
+		t.Fatalf("Get(0) returned %v, want 3", e)
+	}
+	if e, _ := s.At(2); e != 1 {
+		t.Fatalf("At(2) returned %v, want 1", e)
+	}
+	for want := 3; want >= 1; want-- {
+		if e, err := s.Pop(); err != nil || e != want {
+			t.Fatalf("Pop returned %v, %v, want %d", e, err, want)
+		}
+	}
+	if _, err := s.Pop(); err != ErrQueueIsEmpty {
+		t.Fatalf("Pop error %v, want %v", err, ErrQueueIsEmpty)
+	}
+}
+
+func TestStackPositions(t *testing.T) {
+	s := NewStack()
+	_, _ = s.PushN(1, 2, 3)
+	if i := s.IndexFunc(func(e interface{}) bool { return e == 1 }); i != 2 {
+		t.Fatalf("IndexFunc returned %d, want 2", i)
+	}
+	if got := s.Snapshot(); len(got) != 3 || got[0] != 3 || got[2] != 1 {
+		t.Fatalf("Snapshot returned %v, want [3 2 1]", got)
+	}
+	if head, tail, _, _ := s.HeadTail(); head != 3 || tail != 1 {
+		t.Fatalf("HeadTail returned %v, %v, want 3, 1", head, tail)
+	}
+	s.Range(func(i int, e interface{}) (bool, bool) {
+		if e != 3-i {
+			t.Fatalf("Range passed %v at %d, want %d", e, i, 3-i)
+		}
+		return e != 2, false
+	})
+	if got := s.Snapshot(); len(got) != 2 || got[0] != 3 || got[1] != 1 {
+		t.Fatalf("Snapshot after Range returned %v, want [3 1]", got)
+	}
+	_ = s.Push(2)
+	if e, err := s.PopMatch(func(e interface{}) bool { return e != 1 }); err != nil || e != 2 {
+		t.Fatalf("PopMatch returned %v, %v, want 2", e, err)
+	}
+}
+
+func TestLimitedStackOverflow(t *testing.T) {
+	s := NewLimitedStack(2)
+	_ = s.Push(1)
+	_ = s.Push(2)
+	if err := s.Push(3); err != ErrQueueOverflowed {
+		t.Fatalf("Push error %v, want %v", err, ErrQueueOverflowed)
+	}
+	if e, _ := s.Pop(); e != 2 {
+		t.Fatalf("Pop returned %v, want 2", e)
+	}
+}
+
+func TestDroppingStackDropsBottom(t *testing.T) {
+	s := NewQueueWithOptions(QueueWithMaxLen(2), QueueWithDropMode(), QueueWithLIFO())
+	var dropped []interface{}
+	s.OnDrop = func(e interface{}) { dropped = append(dropped, e) }
+	_, _ = s.PushN(1, 2, 3)
+	if len(dropped) != 1 || dropped[0] != 1 {
+		t.Fatalf("dropped %v, want [1]", dropped)
+	}
+	if got := s.Drain(); len(got) != 2 || got[0] != 3 || got[1] != 2 {
+		t.Fatalf("Drain returned %v, want [3 2]", got)
+	}
+}
+
+func TestLimitedQueuePushNBoundary(t *testing.T) {
+	q := NewLimitedQueue(3)
+	if pushed, err := q.PushN(1, 2, 3); pushed != 3 || err != nil {
+		t.Fatalf("PushN returned %d, %v, want 3 pushed up to the limit", pushed, err)
+	}
+	if pushed, err := q.PushN(4); pushed != 0 || err != ErrQueueOverflowed {
+		t.Fatalf("PushN to full queue returned %d, %v, want 0, %v", pushed, err, ErrQueueOverflowed)
+	}
+
+	q = NewLimitedQueue(3)
+	_ = q.Push(1)
+	if pushed, err := q.PushN(2, 3, 4, 5); pushed != 2 || err != ErrQueueOverflowed {
+		t.Fatalf("PushN returned %d, %v, want 2, %v", pushed, err, ErrQueueOverflowed)
+	}
+	if got := q.Snapshot(); len(got) != 3 || got[2] != 3 {
+		t.Fatalf("queue contents %v, want [1 2 3]", got)
+	}
+}
+
+func TestDroppingQueuePushNRetained(t *testing.T) {
+	q := NewDroppingQueue(3)
+	_, _ = q.PushN(1, 2)
+	if pushed, err := q.PushN(3, 4); pushed != 2 || err != nil {
+		t.Fatalf("PushN returned %d, %v, want 2 retained", pushed, err)
+	}
+	if pushed, err := q.PushN(5, 6, 7, 8); pushed != 3 || err != nil {
+		t.Fatalf("PushN returned %d, %v, want 3 retained", pushed, err)
+	}
+	if got := q.Snapshot(); len(got) != 3 || got[0] != 6 || got[2] != 8 {
+		t.Fatalf("queue contents %v, want [6 7 8]", got)
+	}
+}
+
+func TestQueuePopN(t *testing.T) {
+	q := NewLimitedQueue(3)
+	if popped, err := q.PopN(2); popped == nil || len(popped) != 0 || err != nil {
+		t.Fatalf("PopN of empty queue returned %v, %v, want empty slice", popped, err)
+	}
+	_, _ = q.PushN(1, 2, 3)
+	if popped, err := q.PopN(2); len(popped) != 2 || popped[0] != 1 || popped[1] != 2 || err != nil {
+		t.Fatalf("PopN returned %v, %v, want [1 2]", popped, err)
+	}
+	if popped, err := q.PopN(5); len(popped) != 1 || popped[0] != 3 || err != nil {
+		t.Fatalf("PopN returned %v, %v, want [3]", popped, err)
+	}
+}
+
+func TestQueueAppendSliceCountsCoalesced(t *testing.T) {
+	q := NewQueueWithOptions(QueueWithKeyFunc(func(e interface{}) string { return e.(string)[:1] }))
+	accepted, dropped, err := q.AppendSlice([]interface{}{"a1", "a2", "b1"})
+	if accepted != 2 || len(dropped) != 0 || err != nil {
+		t.Fatalf("AppendSlice returned %d, %v, %v, want 2 accepted", accepted, dropped, err)
+	}
+}
+
+func TestQueueSwapContentsOnEmpty(t *testing.T) {
+	q := NewQueue()
+	emptied := 0
+	q.OnEmpty = func() { emptied++ }
+	_ = q.Push(1)
+	q.SwapContents([]interface{}{2})
+	if emptied != 0 {
+		t.Fatalf("OnEmpty called %d times on swapping to non-empty contents, want 0", emptied)
+	}
+	q.SwapContents(nil)
+	if emptied != 1 {
+		t.Fatalf("OnEmpty called %d times on swapping to empty contents, want 1", emptied)
+	}
+}
+
+// countingObserver counts queue operations
+type countingObserver struct{ pushed, popped, dropped int }
+
+func (o *countingObserver) OnPush(interface{}, int)     { o.pushed++ }
+func (o *countingObserver) OnPop(interface{}, int)      { o.popped++ }
+func (o *countingObserver) OnDrop(interface{}, int)     { o.dropped++ }
+func (o *countingObserver) OnOverflow(interface{}, int) {}
+
+func TestQueueStatsAndObserverConsistent(t *testing.T) {
+	observer := &countingObserver{}
+	q := NewQueueWithOptions(QueueWithObserver(observer))
+	check := func(op string) {
+		t.Helper()
+		stats := q.Stats()
+		if int(stats.Pushed-stats.Popped-stats.Dropped) != stats.Len {
+			t.Fatalf("after %s stats %+v don't add up", op, stats)
+		}
+		if uint64(observer.pushed) != stats.Pushed || uint64(observer.popped) != stats.Popped ||
+			uint64(observer.dropped) != stats.Dropped {
+			t.Fatalf("after %s observer %+v doesn't match stats %+v", op, *observer, stats)
+		}
+	}
+
+	_, _ = q.PushN(1, 2, 3)
+	_ = q.Flush(func([]interface{}) error { return errors.New("failed") })
+	check("failed Flush")
+	_ = q.Flush(func([]interface{}) error { return nil })
+	check("Flush")
+
+	_, _ = q.PushN(1, 2)
+	src := NewQueue()
+	_, _ = src.PushN(3, 4)
+	if err := Merge(&q, &src); err != nil {
+		t.Fatal(err)
+	}
+	check("Merge")
+
+	_, _, nack, _ := q.ReservePop()
+	nack()
+	check("nack")
+	q.SwapContents([]interface{}{5})
+	check("SwapContents")
+	q.Clear()
+	check("Clear")
+
+	_, _ = q.PushN(1, 2, 3)
+	q.Range(func(int, interface{}) (bool, bool) { return false, false })
+	check("Range")
+
+	_, _ = q.PushN(1, 2, 3)
+	if err := q.UnmarshalJSON([]byte("[4]")); err != nil {
+		t.Fatal(err)
+	}
+	check("UnmarshalJSON")
+}
+
+func TestQueueFlushReturnsUnrequeued(t *testing.T) {
+	q := NewLimitedQueue(3)
+	_, _ = q.PushN(1, 2)
+	failed := errors.New("failed")
+	err := q.Flush(func([]interface{}) error {
+		_ = q.Push(3)
+		_ = q.Push(4)
+		return failed
+	})
+	var requeueErr RequeueError
+	if !errors.As(err, &requeueErr) || !errors.Is(err, failed) {
+		t.Fatalf("Flush error %v, want RequeueError caused by %v", err, failed)
+	}
+	if len(requeueErr.Elements) != 1 || requeueErr.Elements[0] != 2 {
+		t.Fatalf("unrequeued elements %v, want [2]", requeueErr.Elements)
+	}
+	if got := q.Snapshot(); len(got) != 3 || got[0] != 1 || got[1] != 3 || got[2] != 4 {
+		t.Fatalf("queue contents %v, want [1 3 4]", got)
+	}
+}
+
+func TestQueueFlushUnlocksOnPanic(t *testing.T) {
+	q := NewQueue()
+	q.OnEmpty = func() { panic("OnEmpty") }
+	_ = q.Push(1)
+	func() {
+		defer func() { _ = recover() }()
+		_ = q.Flush(func([]interface{}) error { return nil })
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = q.Push(2)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("queue is left locked after OnEmpty panicked in Flush")
+	}
+}
+
+func TestQueuePopMatch(t *testing.T) {
+	q := NewQueue()
+	if _, err := q.PopMatch(func(interface{}) bool { return true }); err != ErrQueueIsEmpty {
+		t.Fatalf("PopMatch error %v, want %v", err, ErrQueueIsEmpty)
+	}
+	_, _ = q.PushN(1, 2, 3)
+	if e, err := q.PopMatch(func(e interface{}) bool { return e == 2 }); err != nil || e != 2 {
+		t.Fatalf("PopMatch returned %v, %v, want 2", e, err)
+	}
+	if _, err := q.PopMatch(func(e interface{}) bool { return e == 2 }); err != ErrNoMatch {
+		t.Fatalf("PopMatch error %v, want %v", err, ErrNoMatch)
+	}
+	if got := q.Snapshot(); len(got) != 2 || got[0] != 1 || got[1] != 3 {
+		t.Fatalf("queue contents %v, want [1 3]", got)
+	}
+}
+
+func TestQueuePopMatchSkipsExpired(t *testing.T) {
+	q := NewQueueWithOptions(QueueWithTTL(20 * time.Millisecond))
+	_ = q.Push(1)
+	time.Sleep(30 * time.Millisecond)
+	_ = q.Push(2)
+	if e, err := q.PopMatch(func(e interface{}) bool { return e == 1 }); err != ErrNoMatch {
+		t.Fatalf("PopMatch returned %v, %v, want %v as 1 has expired", e, err, ErrNoMatch)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if e, err := q.PopMatch(func(interface{}) bool { return true }); err != ErrQueueIsEmpty {
+		t.Fatalf("PopMatch returned %v, %v, want %v as all elements have expired", e, err, ErrQueueIsEmpty)
+	}
+}
+
+func TestQueueReadsSkipExpired(t *testing.T) {
+	q := NewQueueWithOptions(QueueWithTTL(20 * time.Millisecond))
+	_ = q.Push(1)
+	time.Sleep(30 * time.Millisecond)
+	_ = q.Push(2)
+	if e, err := q.At(0); err != nil || e != 2 {
+		t.Fatalf("At(0) returned %v, %v, want 2", e, err)
+	}
+	_ = q.Push(3)
+	time.Sleep(30 * time.Millisecond)
+	_ = q.Push(4)
+	if i := q.IndexFunc(func(e interface{}) bool { return e == 3 }); i != -1 {
+		t.Fatalf("IndexFunc returned %d for expired element, want -1", i)
+	}
+	_ = q.Push(5)
+	time.Sleep(30 * time.Millisecond)
+	_ = q.Push(6)
+	if got := q.Snapshot(); len(got) != 1 || got[0] != 6 {
+		t.Fatalf("Snapshot returned %v, want [6]", got)
+	}
+	time.Sleep(30 * time.Millisecond)
+	q.Each(func(e interface{}) { t.Fatalf("Each iterated over expired %v", e) })
+}
+
+func TestQueueClearPops(t *testing.T) {
+	q := NewQueue()
+	q.OnDrop = func(e interface{}) { t.Fatalf("OnDrop called for %v on Clear", e) }
+	emptied := 0
+	q.OnEmpty = func() { emptied++ }
+	_, _ = q.PushN(1, 2)
+	q.Clear()
+	if stats := q.Stats(); stats.Len != 0 || stats.Popped != 2 || stats.Dropped != 0 {
+		t.Fatalf("stats after Clear %+v, want 2 popped", stats)
+	}
+	if emptied != 1 {
+		t.Fatalf("OnEmpty called %d times, want 1", emptied)
+	}
+}
+
+func TestQueueExpiryOnEmpty(t *testing.T) {
+	q := NewQueueWithOptions(QueueWithTTL(20 * time.Millisecond))
+	emptied := 0
+	q.OnEmpty = func() { emptied++ }
+	_, _ = q.PushN(1, 2)
+	time.Sleep(30 * time.Millisecond)
+	if _, err := q.Pop(); err != ErrQueueIsEmpty {
+		t.Fatalf("Pop error %v, want %v", err, ErrQueueIsEmpty)
+	}
+	if emptied != 1 {
+		t.Fatalf("OnEmpty called %d times on expiry, want 1", emptied)
+	}
+
+	_ = q.Push(1)
+	time.Sleep(30 * time.Millisecond)
+	_ = q.Push(2)
+	if _, err := q.Seek(func(e interface{}) bool { return e == 3 }); err != ErrQueueIsEmpty {
+		t.Fatalf("Seek error %v, want %v", err, ErrQueueIsEmpty)
+	}
+	if emptied != 2 {
+		t.Fatalf("OnEmpty called %d times, want 2", emptied)
+	}
+}
+
+func TestQueueReportOldestAge(t *testing.T) {
+	q := NewQueueWithOptions(QueueWithTTL(time.Minute))
+	_ = q.Push(1)
+	time.Sleep(10 * time.Millisecond)
+	if r := q.Report(); r.OldestAge < 10*time.Millisecond {
+		t.Fatalf("OldestAge %s of queue with TTL, want at least 10ms", r.OldestAge)
+	}
+
+	q = NewLimitedQueue(2)
+	_ = q.Push(1)
+	r := q.Report()
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.OldestAge != 0 || bytes.Contains(data, []byte("oldestAge")) {
+		t.Fatalf("report %s of queue without TTL has OldestAge", data)
+	}
+}
+
+func TestNamedQueueTryLock(t *testing.T) {
+	q := NewNamedQueue("queue")
+	q.Lock()
+	if q.TryLock() {
+		t.Fatal("TryLock locked the named queue held by Lock")
+	}
+	q.Unlock()
+	if !q.TryLock() {
+		t.Fatal("TryLock failed to lock the unlocked named queue")
+	}
+	if !q.mu.IsLocked() {
+		t.Fatal("TryLock didn't lock the underlying Mutex")
+	}
+	q.Unlock()
+}
+
+func TestQueueResize(t *testing.T) {
+	q := NewLimitedQueue(3)
+	_, _ = q.PushN(1, 2, 3)
+	if dropped := q.Resize(2, false); len(dropped) != 1 || dropped[0] != 3 {
+		t.Fatalf("Resize dropped %v, want [3]", dropped)
+	}
+	q.Resize(-1, true)
+	if err := q.Push(4); err != nil {
+		t.Fatalf("Push after negative Resize returned %v, want no limit", err)
+	}
+
+	q = NewElasticQueue(2, 8)
+	q.Resize(3, true)
+	if _, err := q.PushN(1, 2, 3, 4); err != ErrQueueOverflowed {
+		t.Fatalf("PushN error %v, want %v as the elastic queue grew past Resize", err, ErrQueueOverflowed)
+	}
+	if n := q.Len(); n != 3 {
+		t.Fatalf("Len %d, want 3", n)
+	}
+}
+
+func TestQueueReservePopVisibilityTimeout(t *testing.T) {
+	q := NewQueueWithOptions(QueueWithVisibilityTimeout(20 * time.Millisecond))
+	_ = q.Push(1)
+	e, ack, _, err := q.ReservePop()
+	if err != nil || e != 1 {
+		t.Fatalf("ReservePop returned %v, %v, want 1", e, err)
+	}
+	if n, inFlight := q.Len(), q.InFlight(); n != 0 || inFlight != 1 {
+		t.Fatalf("Len %d, InFlight %d after ReservePop, want 0, 1", n, inFlight)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if n, inFlight := q.Len(), q.InFlight(); n != 1 || inFlight != 0 {
+		t.Fatalf("Len %d, InFlight %d after visibility timeout, want 1, 0", n, inFlight)
+	}
+	ack()
+	if n := q.Len(); n != 1 {
+		t.Fatalf("Len %d after ack of the redelivered element, want 1", n)
+	}
+	if e, err := q.Pop(); err != nil || e != 1 {
+		t.Fatalf("Pop returned %v, %v, want redelivered 1", e, err)
+	}
+}
+
+func TestQueueReservePopAckAndNack(t *testing.T) {
+	q := NewQueueWithOptions(QueueWithVisibilityTimeout(20 * time.Millisecond))
+	_, _ = q.PushN(1, 2)
+	_, ack, nack, _ := q.ReservePop()
+	ack()
+	nack()
+	time.Sleep(40 * time.Millisecond)
+	if got := q.Snapshot(); len(got) != 1 || got[0] != 2 {
+		t.Fatalf("queue contents %v after ack, want [2]", got)
+	}
+
+	_, ack, nack, _ = q.ReservePop()
+	nack()
+	nack()
+	ack()
+	time.Sleep(40 * time.Millisecond)
+	if got := q.Snapshot(); len(got) != 1 || got[0] != 2 || q.InFlight() != 0 {
+		t.Fatalf("queue contents %v, InFlight %d after nack, want [2], 0", got, q.InFlight())
+	}
+}
+
+func TestQueuePopWaitConsumers(t *testing.T) {
+	q := NewQueue()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const consumers = 4
+	resultC := make(chan interface{}, consumers+1)
+	errC := make(chan error, consumers+1)
+	for i := 0; i < consumers+1; i++ {
+		go func() {
+			e, err := q.PopWait(ctx)
+			if err != nil {
+				errC <- err
+				return
+			}
+			resultC <- e
+		}()
+	}
+	for i := 0; i < consumers; i++ {
+		_ = q.Push(i)
+	}
+	got := make(map[interface{}]bool)
+	for i := 0; i < consumers; i++ {
+		select {
+		case e := <-resultC:
+			if got[e] {
+				t.Fatalf("element %v popped twice", e)
+			}
+			got[e] = true
+		case <-time.After(time.Second):
+			t.Fatalf("%d of %d elements popped", len(got), consumers)
+		}
+	}
+	cancel()
+	select {
+	case err := <-errC:
+		if err != context.Canceled {
+			t.Fatalf("PopWait error %v, want %v", err, context.Canceled)
+		}
+	case e := <-resultC:
+		t.Fatalf("extra consumer popped %v", e)
+	case <-time.After(time.Second):
+		t.Fatal("waiting consumer is not released by cancellation")
+	}
+}
+
+func TestQueueWorkersStopReleasesBlocked(t *testing.T) {
+	q := NewQueue()
+	w := q.StartWorkers(3, func(interface{}) {})
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := w.Stop(ctx); err != nil {
+		t.Fatalf("Stop of workers blocked on empty queue returned %v", err)
+	}
+}
+
+func TestQueueWorkersStopDrains(t *testing.T) {
+	q := NewQueue()
+	var mu sync.Mutex
+	handled := 0
+	w := q.StartWorkers(2, func(interface{}) {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		handled++
+		mu.Unlock()
+	})
+	for i := 0; i < 20; i++ {
+		_ = q.Push(i)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := w.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if handled != 20 || q.Len() != 0 {
+		t.Fatalf("handled %d, left %d after Stop, want all 20 handled", handled, q.Len())
+	}
+}
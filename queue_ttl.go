@@ -0,0 +1,120 @@
+package synced
+
+import "time"
+
+// QueueWithTTL makes the queue expire elements pushed more than ttl ago. Expired elements are never returned,
+// they are dropped when they are reached by popping or by reading the queue contents, e.g. with Get, At,
+// IndexFunc, Snapshot or Each, or by the expiry sweeper, see StartExpirySweeper.
+// Elements pushed back by Flush on error or by nack keep their push time,
+// elements requeued by RequeueOrDeadLetter are treated as pushed anew.
+func QueueWithTTL(ttl time.Duration) QueueOption { return func(q *Queue) { q.ttl = ttl } }
+
+// pushed records the push time of n elements appended to the queue if it has TTL
+func (q *Queue) pushed(n int) {
+	if q.ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		q.pushedAt = append(q.pushedAt, now)
+	}
+}
+
+// expired returns whether the element at position i has expired
+func (q *Queue) expired(i int, now time.Time) bool {
+	return q.ttl > 0 && now.Sub(q.pushedAt[i]) >= q.ttl
+}
+
+// dropExpiredTop drops expired elements from where they are popped, so the element to be popped next
+// is never expired. Expired elements behind a live one are left for popping or the expiry sweeper,
+// as the push times of requeued elements may be out of order
+func (q *Queue) dropExpiredTop() {
+	n := q.len()
+	now := time.Now()
+	for q.len() > 0 && q.expired(q.top(), now) {
+		element, _ := q.removeTop()
+		q.dropped(element)
+	}
+	q.emptied(n)
+}
+
+// nonEmpty returns whether there is an element to pop, expired elements are dropped first
+func (q *Queue) nonEmpty() bool {
+	q.dropExpiredTop()
+	return q.len() > 0
+}
+
+// dropExpired drops all expired elements from the queue. Returns the number of dropped elements
+func (q *Queue) dropExpired() int {
+	if q.ttl <= 0 {
+		return 0
+	}
+	n := q.len()
+	now := time.Now()
+	kept, keptAt := q.queue[:0], q.pushedAt[:0]
+	for i, e := range q.queue {
+		if !q.expired(i, now) {
+			kept, keptAt = append(kept, e), append(keptAt, q.pushedAt[i])
+			continue
+		}
+		q.bytes -= q.sizeOfElement(e)
+		q.indexKey(e, -1)
+		q.dropped(e)
+	}
+	for i := len(kept); i < n; i++ {
+		q.queue[i] = nil
+	}
+	q.queue, q.pushedAt = kept, keptAt
+	if q.len() < n {
+		q.notify()
+		q.emptied(n)
+	}
+	return n - q.len()
+}
+
+// DropExpired drops all expired elements from the queue calling OnDrop for each of them.
+// Returns the number of dropped elements
+func (q *Queue) DropExpired() int {
+	q.Lock()
+	defer q.Unlock()
+	return q.dropExpired()
+}
+
+// StartExpirySweeper starts dropping expired elements every interval, as by DropExpired,
+// even if nobody pops them. A sweeper started before is stopped. It should be stopped with StopExpirySweeper.
+// The queue is swept at most once a millisecond, a shorter or non-positive interval is raised to that.
+func (q *Queue) StartExpirySweeper(interval time.Duration) {
+	q.Lock()
+	defer q.Unlock()
+	q.stopExpirySweeper()
+	ticker := time.NewTicker(clampInterval(interval))
+	stopC := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				q.DropExpired()
+			case <-stopC:
+				return
+			}
+		}
+	}()
+	q.stopSweeper = func() {
+		ticker.Stop()
+		close(stopC)
+	}
+}
+
+func (q *Queue) stopExpirySweeper() {
+	if q.stopSweeper != nil {
+		q.stopSweeper()
+		q.stopSweeper = nil
+	}
+}
+
+// StopExpirySweeper stops the expiry sweeper if it was started
+func (q *Queue) StopExpirySweeper() {
+	q.Lock()
+	defer q.Unlock()
+	q.stopExpirySweeper()
+}
@@ -0,0 +1,80 @@
+package synced
+
+import (
+	"context"
+	"sync"
+)
+
+// QueueWorkers is a group of goroutines processing queue elements
+type QueueWorkers struct {
+	q        *Queue
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	stopping bool // guarded by the queue lock
+}
+
+// StartWorkers starts n goroutines each popping elements from the queue, waiting for them
+// if the queue is empty, and calling handler with them. Workers should be stopped with Stop.
+func (q *Queue) StartWorkers(n int, handler func(interface{})) *QueueWorkers {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &QueueWorkers{q: q, cancel: cancel}
+	w.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer w.wg.Done()
+			for {
+				element, ok := w.next(ctx)
+				if !ok {
+					return
+				}
+				handler(element)
+			}
+		}()
+	}
+	return w
+}
+
+// next waits for the next element to handle. Returns false if the worker should exit
+func (w *QueueWorkers) next(ctx context.Context) (interface{}, bool) {
+	if ctx.Err() != nil {
+		return nil, false
+	}
+	w.q.Lock()
+	defer w.q.Unlock()
+	for {
+		if err := w.q.wait(ctx, func() bool { return w.q.nonEmpty() || w.stopping }); err != nil {
+			return nil, false
+		}
+		if element, err := w.q.pop(); err == nil {
+			return element, true
+		}
+		if w.stopping {
+			return nil, false
+		}
+	}
+}
+
+// Stop makes the workers drain the queue and exit, and waits for them. If ctx is done before the queue
+// is drained, the workers exit after handling their current elements and ctx.Err() is returned.
+func (w *QueueWorkers) Stop(ctx context.Context) error {
+	w.q.Lock()
+	w.stopping = true
+	w.q.notify()
+	w.q.Unlock()
+
+	doneC := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(doneC)
+	}()
+
+	select {
+	case <-doneC:
+		w.cancel()
+		return nil
+	case <-ctx.Done():
+		w.cancel()
+		<-doneC
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,92 @@
+package synced
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrUnknownReservation is returned on committing or rolling back a reservation
+// which was never prepared or was already committed or rolled back
+var ErrUnknownReservation = errors.New("unknown reservation")
+
+// ReservationToken identifies a reservation prepared by ReservationCounter
+type ReservationToken uint64
+
+// ReservationCounter is a thread-safe counter of available units which are reserved
+// with Prepare and then either consumed with Commit or returned with Rollback
+type ReservationCounter struct {
+	available int
+	reserved  map[ReservationToken]int
+	lastToken ReservationToken
+	sync.Mutex
+}
+
+// NewReservationCounter returns a pointer to a new reservation counter with available units
+func NewReservationCounter(available int) *ReservationCounter {
+	return &ReservationCounter{available: available, reserved: make(map[ReservationToken]int)}
+}
+
+// Prepare tentatively reserves n units. Returns the reservation token and true,
+// or false if less than n units are available
+func (c *ReservationCounter) Prepare(n int) (ReservationToken, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if c.available < n {
+		return 0, false
+	}
+	c.available -= n
+	c.lastToken++
+	c.reserved[c.lastToken] = n
+	return c.lastToken, true
+}
+
+// Commit finalizes the reservation, the reserved units are consumed
+func (c *ReservationCounter) Commit(token ReservationToken) error {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.reserved[token]; !ok {
+		return ErrUnknownReservation
+	}
+	delete(c.reserved, token)
+	return nil
+}
+
+// Rollback cancels the reservation, the reserved units become available again
+func (c *ReservationCounter) Rollback(token ReservationToken) error {
+	c.Lock()
+	defer c.Unlock()
+	n, ok := c.reserved[token]
+	if !ok {
+		return ErrUnknownReservation
+	}
+	delete(c.reserved, token)
+	c.available += n
+	return nil
+}
+
+// Add i units to available ones. Returns original number of available units
+func (c *ReservationCounter) Add(i int) int {
+	c.Lock()
+	defer c.Unlock()
+	v := c.available
+	c.available += i
+	return v
+}
+
+// Available returns the number of units available for reservation
+func (c *ReservationCounter) Available() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.available
+}
+
+// Reserved returns the number of units reserved but neither committed nor rolled back yet
+func (c *ReservationCounter) Reserved() int {
+	c.Lock()
+	defer c.Unlock()
+	reserved := 0
+	for _, n := range c.reserved {
+		reserved += n
+	}
+	return reserved
+}
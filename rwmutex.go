@@ -1,5 +1,7 @@
 package synced
 
+import "sync/atomic"
+
 // RWMutex adds debugging-related functionality to sync.RWMutex
 type RWMutex struct {
 	*Mutex
@@ -9,6 +11,13 @@ type RWMutex struct {
 	BeforeRUnlock       func()
 	AfterRUnlock        func()
 	AfterRUnlockRecover func(r interface{})
+
+	// readers is the number of read lock holders, the read lock hold duration
+	// reported by the watchdog is measured since the first of them acquired the lock
+	readers       int
+	stopReadWatch func()
+
+	readLocks int32 // number of the read lock holders, to detect RUnlock misuse
 }
 
 // NewRWMutex returns a pointer to a new RWMutex with default callbacks assigned
@@ -17,69 +26,122 @@ func NewRWMutex(p MutexParams) *RWMutex {
 	m := &RWMutex{Mutex: NewMutex(p)}
 	if p.SetDefaultCallbacks {
 		m.BeforeRLock = func() { m.defaultCallback("BeforeRLock", mname, p) }
-		m.AfterRLock = func() { m.defaultCallback("AfterRLock", mname, p) }
-		m.BeforeRUnlock = func() { m.defaultCallback("BeforeRUnlock", mname, p) }
+		readTimeout := p.ReadTimeout
+		if readTimeout == 0 {
+			readTimeout = p.Timeout
+		}
+		m.AfterRLock = func() {
+			m.defaultCallback("AfterRLock", mname, p)
+			m.readers++
+			if m.readers == 1 {
+				m.stopReadWatch = m.watch(mname, "RLock", readTimeout, p)
+			}
+		}
+		m.BeforeRUnlock = func() {
+			if m.readers > 0 {
+				m.readers--
+				if m.readers == 0 && m.stopReadWatch != nil {
+					m.stopReadWatch()
+					m.stopReadWatch = nil
+				}
+			}
+			m.defaultCallback("BeforeRUnlock", mname, p)
+		}
 		m.AfterRUnlock = func() { m.defaultCallback("AfterRUnlock", mname, p) }
 		m.AfterRUnlockRecover = func(r interface{}) { m.defaultCallback1("AfterRUnlockRecover", mname, p, r) }
 	}
 	return m
 }
 
+// SetCallbacksEnabled enables or disables calling the callbacks of both write and read locks,
+// see Mutex.SetCallbacksEnabled. Disabling stops the watchdog of the current read lock holds.
+func (m *RWMutex) SetCallbacksEnabled(enabled bool) {
+	m.Mutex.SetCallbacksEnabled(enabled)
+	if enabled {
+		return
+	}
+	m.callbacksMu.Lock()
+	defer m.callbacksMu.Unlock()
+	m.readers = 0
+	if m.stopReadWatch != nil {
+		m.stopReadWatch()
+		m.stopReadWatch = nil
+	}
+}
+
+// WithUpgradableLock read locks the mutex and calls fn, unlocking the mutex after fn returns.
+// Calling upgrade within fn promotes the read lock to the write lock for the rest of fn.
+// The promotion releases the read lock before locking for write, so upgrade returns true only if
+// no other goroutine has locked for write in between, and everything read under the read lock is still valid.
+// If it returns false, the write lock is held anyway but the state must be read again.
+// Calling upgrade again after the promotion returns true, calling it after fn returned returns false.
+func (m *RWMutex) WithUpgradableLock(fn func(upgrade func() bool)) {
+	var upgraded, done bool
+	m.RLock()
+	gen := m.writeGeneration()
+	defer func() {
+		done = true
+		if upgraded {
+			m.Unlock()
+			return
+		}
+		m.RUnlock()
+	}()
+	fn(func() bool {
+		if done {
+			return false
+		}
+		if upgraded {
+			return true
+		}
+		m.RUnlock()
+		m.Lock()
+		upgraded = true
+		return m.writeGeneration() == gen+1
+	})
+}
+
 // RLock calls the underlying RWMutex.RLock method. BeforeRLock and AfterRLock callbacks will be executed
 // before and after such call respectively. If callback was not specified, it will be ignored.
 func (m *RWMutex) RLock() {
-	func() {
-		m.callbacksMu.Lock()
-		defer m.callbacksMu.Unlock()
-		if m.BeforeRLock != nil {
-			m.BeforeRLock()
-		}
-	}()
+	m.callback(&m.BeforeRLock)
 
+	atomic.AddInt32(&m.waiters, 1)
 	m.Mutex.mu.RLock()
+	atomic.AddInt32(&m.readLocks, 1)
+	atomic.AddInt32(&m.waiters, -1)
+	m.trace("RLock", nil)
+
+	m.callback(&m.AfterRLock)
+}
 
-	func() {
-		m.callbacksMu.Lock()
-		defer m.callbacksMu.Unlock()
-		if m.AfterRLock != nil {
-			m.AfterRLock()
+// releaseReadLock decrements the number of the read lock holders. Returns false if there are none
+func (m *RWMutex) releaseReadLock() bool {
+	for {
+		n := atomic.LoadInt32(&m.readLocks)
+		if n == 0 {
+			return false
 		}
-	}()
+		if atomic.CompareAndSwapInt32(&m.readLocks, n, n-1) {
+			return true
+		}
+	}
 }
 
 // RUnlock calls the underlying RWMutex.RUnlock method. BeforeRUnlock and AfterRUnlock callbacks will be executed
-// before and after such call respectively. If a panic will occur at underlying RWMutex unlocking, it will be
-// handled by a call to recover() and BeforeRUnlockRecover and AfterRUnlockRecover will be called respectively.
-// If callback was not specified, it will be ignored.
+// before and after such call respectively. Unlocking of the mutex which is not read locked is detected before
+// the underlying unlock, which would be a fatal error otherwise: AfterRUnlockRecover is called with UnlockPanic
+// instead, and it is panicked with if MutexParams.PanicOnMisuse was set. If callback was not specified,
+// it will be ignored.
 func (m *RWMutex) RUnlock() {
-	func() {
-		m.callbacksMu.Lock()
-		defer m.callbacksMu.Unlock()
-		if m.BeforeRUnlock != nil {
-			m.BeforeRUnlock()
-		}
-	}()
+	m.callback(&m.BeforeRUnlock)
 
-	defer func() {
-		r := recover()
-		if r == nil {
-			return
-		}
-		func() {
-			m.callbacksMu.Lock()
-			defer m.callbacksMu.Unlock()
-			if m.AfterRUnlockRecover != nil {
-				m.AfterRUnlockRecover(r)
-			}
-		}()
-	}()
+	if !m.releaseReadLock() {
+		m.unlockMisused(UnlockPanic{Name: m.name, Value: errRUnlockOfUnlocked}, &m.AfterRUnlockRecover)
+		return
+	}
 	m.Mutex.mu.RUnlock()
+	m.trace("RUnlock", nil)
 
-	func() {
-		m.callbacksMu.Lock()
-		defer m.callbacksMu.Unlock()
-		if m.AfterRUnlock != nil {
-			m.AfterRUnlock()
-		}
-	}()
+	m.callback(&m.AfterRUnlock)
 }
@@ -0,0 +1,81 @@
+package synced
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRWMutexUpgradeWithoutWriter(t *testing.T) {
+	m := NewRWMutex(MutexParams{})
+	m.WithUpgradableLock(func(upgrade func() bool) {
+		if !upgrade() {
+			t.Fatal("upgrade returned false without a write in between")
+		}
+		if !m.IsLocked() {
+			t.Fatal("write lock is not held after upgrade")
+		}
+		if !upgrade() {
+			t.Fatal("repeated upgrade returned false")
+		}
+	})
+	if m.IsLocked() {
+		t.Fatal("write lock is left held")
+	}
+}
+
+func TestRWMutexUpgradeAfterWriter(t *testing.T) {
+	m := NewRWMutex(MutexParams{})
+	value := 1
+	writtenC := make(chan struct{})
+	m.WithUpgradableLock(func(upgrade func() bool) {
+		read := value
+		go func() {
+			defer close(writtenC)
+			m.Lock()
+			value = 2
+			m.Unlock()
+		}()
+		// let the writer block on the read lock, so it gets the lock released by upgrade first
+		for m.Waiters() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if upgrade() {
+			t.Fatalf("upgrade returned true though the value changed from %d to %d in between", read, value)
+		}
+		if value != 2 {
+			t.Fatalf("value %d re-read after upgrade, want 2", value)
+		}
+		value++
+	})
+	<-writtenC
+	if value != 3 {
+		t.Fatalf("value %d, want 3", value)
+	}
+}
+
+func TestRWMutexConcurrentUpgraders(t *testing.T) {
+	m := NewRWMutex(MutexParams{})
+	value := 0
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				m.WithUpgradableLock(func(upgrade func() bool) {
+					read := value
+					if !upgrade() {
+						read = value
+					}
+					value = read + 1
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if value != 16*100 {
+		t.Fatalf("value %d, want %d", value, 16*100)
+	}
+}
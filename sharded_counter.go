@@ -0,0 +1,81 @@
+package synced
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// counterShard is a part of ShardedCounter padded to avoid false sharing of cache lines between shards
+type counterShard struct {
+	count int
+	sync.Mutex
+	_ [48]byte
+}
+
+// ShardedCounter is a thread-safe integer counter split into independently locked shards
+// to reduce the write contention. Reading it sums the shards, so it is not an instant snapshot
+// if the counter is updated concurrently.
+type ShardedCounter struct {
+	shards []counterShard
+	next   uint32    // shard assigned to the next index put into positions, accessed atomically
+	index  sync.Pool // shard positions for keyless updates, cached per processor by the pool
+}
+
+// NewShardedCounter returns a pointer to a new sharded counter with n shards. At least one shard is used
+func NewShardedCounter(n int) *ShardedCounter {
+	if n < 1 {
+		n = 1
+	}
+	c := &ShardedCounter{shards: make([]counterShard, n)}
+	c.index.New = func() interface{} {
+		pos := int(atomic.AddUint32(&c.next, 1) % uint32(len(c.shards)))
+		return &pos
+	}
+	return c
+}
+
+// add i to the shard at position pos
+func (c *ShardedCounter) add(pos int, i int) {
+	shard := &c.shards[pos]
+	shard.Lock()
+	defer shard.Unlock()
+	shard.count += i
+}
+
+// Inc increases counter by 1, see Add
+func (c *ShardedCounter) Inc() { c.Add(1) }
+
+// Add i to counter. The shard is chosen by the processor running the calling goroutine,
+// so concurrent updates from different processors mostly go to different shards
+func (c *ShardedCounter) Add(i int) {
+	pos := c.index.Get().(*int)
+	c.add(*pos, i)
+	c.index.Put(pos)
+}
+
+// IncKey increases counter by 1, see AddKey
+func (c *ShardedCounter) IncKey(key string) { c.AddKey(key, 1) }
+
+// AddKey adds i to counter updating the shard chosen by the hash of key,
+// so updates with the same key always go to the same shard
+func (c *ShardedCounter) AddKey(key string, i int) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	c.add(int(h.Sum32()%uint32(len(c.shards))), i)
+}
+
+// Get returns the sum of the shards
+func (c *ShardedCounter) Get() int {
+	sum := 0
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.Lock()
+		sum += shard.count
+		shard.Unlock()
+	}
+	return sum
+}
+
+// Shards returns the number of shards
+func (c *ShardedCounter) Shards() int { return len(c.shards) }
@@ -0,0 +1,44 @@
+package synced
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestShardedCounterConcurrentAdd(t *testing.T) {
+	c := NewShardedCounter(4)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				c.Add(2)
+				c.IncKey("key")
+			}
+		}()
+	}
+	wg.Wait()
+	if v := c.Get(); v != 8*1000*3 {
+		t.Fatalf("Get returned %d, want %d", v, 8*1000*3)
+	}
+}
+
+func BenchmarkCounterParallel(b *testing.B) {
+	c := NewCounter(0)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.Inc()
+		}
+	})
+}
+
+func BenchmarkShardedCounterParallel(b *testing.B) {
+	c := NewShardedCounter(4 * runtime.GOMAXPROCS(0))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c.Inc()
+		}
+	})
+}
@@ -0,0 +1,59 @@
+package synced
+
+import "sync"
+
+// WindowCounter is a thread-safe sum of the last n observed values
+type WindowCounter struct {
+	values []int
+	pos    int
+	sum    int
+	sync.Mutex
+}
+
+// NewWindowCounter returns a pointer to a new counter over the window of n last values.
+// At least one value is kept
+func NewWindowCounter(n int) *WindowCounter {
+	if n < 1 {
+		n = 1
+	}
+	return &WindowCounter{values: make([]int, 0, n)}
+}
+
+// Add v to the window evicting the earliest value if the window is full. Returns resulting sum
+func (c *WindowCounter) Add(v int) int {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.values) < cap(c.values) {
+		c.values = append(c.values, v)
+	} else {
+		c.sum -= c.values[c.pos]
+		c.values[c.pos] = v
+		c.pos = (c.pos + 1) % len(c.values)
+	}
+	c.sum += v
+	return c.sum
+}
+
+// Sum returns the sum of values in the window
+func (c *WindowCounter) Sum() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.sum
+}
+
+// Avg returns the average of values in the window, 0 if it is empty
+func (c *WindowCounter) Avg() float64 {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.values) == 0 {
+		return 0
+	}
+	return float64(c.sum) / float64(len(c.values))
+}
+
+// Len returns the number of values in the window
+func (c *WindowCounter) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.values)
+}